@@ -0,0 +1,152 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// Clear-sky model for solar radiation and UV index plausibility.
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ebarkie/weatherlink/data"
+)
+
+const (
+	solarConstant = 1361.0 // Total solar irradiance in w/m²
+
+	// Cloud edges can briefly focus more radiation than a clear sky so
+	// values are only suspect when they're well above the model.
+	clearSkySolarFactor = 1.5
+	clearSkySolarMargin = 50.0 // w/m²
+	clearSkyUVFactor    = 1.5
+	clearSkyUVMargin    = 1.0
+)
+
+// location is the station location.
+type location struct {
+	Lat  float64 `json:"latitude"`
+	Lon  float64 `json:"longitude"`
+	Elev float64 `json:"elevation"` // Feet
+}
+
+// valid returns true if the location has been configured.
+func (loc location) valid() bool {
+	return loc.Lat != 0 || loc.Lon != 0
+}
+
+// cosZenith returns the cosine of the solar zenith angle at the location
+// and time using the NOAA general solar position equations.
+func (loc location) cosZenith(t time.Time) float64 {
+	t = t.In(time.UTC)
+	hours := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+
+	// Fractional year in radians
+	g := 2 * math.Pi / 365 * (float64(t.YearDay()-1) + (hours-12)/24)
+
+	// Equation of time in minutes and declination in radians
+	eqTime := 229.18 * (0.000075 + 0.001868*math.Cos(g) - 0.032077*math.Sin(g) -
+		0.014615*math.Cos(2*g) - 0.040849*math.Sin(2*g))
+	decl := 0.006918 - 0.399912*math.Cos(g) + 0.070257*math.Sin(g) -
+		0.006758*math.Cos(2*g) + 0.000907*math.Sin(2*g) -
+		0.002697*math.Cos(3*g) + 0.00148*math.Sin(3*g)
+
+	// True solar time in minutes and hour angle in radians
+	tst := hours*60 + eqTime + 4*loc.Lon
+	ha := (tst/4 - 180) * math.Pi / 180
+
+	lat := loc.Lat * math.Pi / 180
+	return math.Sin(lat)*math.Sin(decl) + math.Cos(lat)*math.Cos(decl)*math.Cos(ha)
+}
+
+// clearSky returns the theoretical clear-sky solar radiation in w/m² and UV
+// index at the location and time.
+//
+// Solar radiation is the FAO-56 clear-sky fraction of the extraterrestrial
+// radiation, which increases with elevation.  UV index is the Madronich
+// approximation with an 8% increase per kilometer of elevation.
+func (loc location) clearSky(t time.Time) (solar, uv float64) {
+	cosZ := loc.cosZenith(t)
+	if cosZ <= 0 {
+		return
+	}
+
+	elev := loc.Elev * 0.3048 // Meters
+	dist := 1 + 0.033*math.Cos(2*math.Pi*float64(t.YearDay())/365)
+	solar = (0.75 + 2e-5*elev) * solarConstant * dist * cosZ
+	uv = 12.5 * math.Pow(cosZ, 2.42) * (1 + 0.08*elev/1000)
+
+	return
+}
+
+// maxClearSky returns the largest clear-sky solar radiation and UV index at
+// the location between begin and end.  Checking a few points is sufficient
+// since it changes smoothly.
+func (loc location) maxClearSky(begin, end time.Time) (solar, uv float64) {
+	const steps = 4
+	for i := 0; i <= steps; i++ {
+		s, u := loc.clearSky(begin.Add(end.Sub(begin) * time.Duration(i) / steps))
+		solar, uv = math.Max(solar, s), math.Max(uv, u)
+	}
+
+	return
+}
+
+// assertClearSky checks that a value isn't well above the clear-sky maximum.
+func (qc *qualityControl) assertClearSky(f string, v, max, factor, margin float64) {
+	if limit := max*factor + margin; v > limit {
+		qc.errs = append(qc.errs, qcError{
+			rule:  ruleClearSky,
+			field: f,
+			msg:   fmt.Sprintf("(%s) %.1f exceeds clear-sky maximum %.1f", f, v, max),
+		})
+	}
+}
+
+// clearSkyCheck takes a Loop packet and compares the solar radiation and UV
+// index to the clear-sky maximums for the station location.  Values that are
+// well above them indicate a dirty or unlevel sensor or an electronic fault.
+// A qualityControl struct is returned indicating if it passed or not.  If it
+// failed a slice of error descriptions are included.
+func clearSkyCheck(l loop, loc location) (qc qualityControl) {
+	if loc.valid() && !l.Timestamp.IsZero() {
+		solar, uv := loc.clearSky(l.Timestamp)
+		qc.assertClearSky("solarRadiation", float64(l.SolarRad), solar, clearSkySolarFactor, clearSkySolarMargin)
+		qc.assertClearSky("UVIndex", l.UVIndex, uv, clearSkyUVFactor, clearSkyUVMargin)
+	}
+
+	if len(qc.errs) > 0 {
+		qc.passed = false
+	} else {
+		qc.passed = true
+	}
+
+	return
+}
+
+// archiveClearSkyCheck takes an archive record and compares the average
+// solar radiation and UV index to the clear-sky maximums for the station
+// location over the interval the record covers.  A qualityControl struct is
+// returned indicating if it passed or not.  If it failed a slice of error
+// descriptions are included.
+func archiveClearSkyCheck(a data.Archive, as []data.Archive, loc location) (qc qualityControl) {
+	if loc.valid() && !a.Timestamp.IsZero() {
+		begin := a.Timestamp.Add(-5 * time.Minute)
+		if len(as) > 0 && as[0].Timestamp.Before(a.Timestamp) && a.Timestamp.Sub(as[0].Timestamp) <= 2*time.Hour {
+			begin = as[0].Timestamp
+		}
+		solar, uv := loc.maxClearSky(begin, a.Timestamp)
+		qc.assertClearSky("solarRadiation", float64(a.SolarRad), solar, clearSkySolarFactor, clearSkySolarMargin)
+		qc.assertClearSky("UVIndexAverage", a.UVIndexAvg, uv, clearSkyUVFactor, clearSkyUVMargin)
+	}
+
+	if len(qc.errs) > 0 {
+		qc.passed = false
+	} else {
+		qc.passed = true
+	}
+
+	return
+}
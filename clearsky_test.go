@@ -0,0 +1,62 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ebarkie/weatherlink/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClearSky(t *testing.T) {
+	a := assert.New(t)
+
+	loc := location{Lat: 38.9, Lon: -77.0, Elev: 100}
+
+	// Solar noon at the summer solstice
+	solar, uv := loc.clearSky(time.Date(2016, time.June, 20, 17, 12, 0, 0, time.UTC))
+	a.InDelta(950.0, solar, 20.0, "Solstice noon solar radiation")
+	a.InDelta(11.4, uv, 0.5, "Solstice noon UV index")
+
+	// Winter afternoon is lower and night is zero
+	winter, _ := loc.clearSky(time.Date(2016, time.December, 21, 19, 0, 0, 0, time.UTC))
+	a.True(winter < solar/2, "Winter is much lower than summer")
+	solar, uv = loc.clearSky(time.Date(2016, time.June, 21, 5, 0, 0, 0, time.UTC))
+	a.Equal(0.0, solar, "Night solar radiation")
+	a.Equal(0.0, uv, "Night UV index")
+}
+
+func TestClearSkyCheck(t *testing.T) {
+	a := assert.New(t)
+
+	loc := location{Lat: 38.9, Lon: -77.0, Elev: 100}
+	l := loop{Timestamp: time.Date(2016, time.June, 20, 17, 12, 0, 0, time.UTC)}
+	l.SolarRad = 1050
+	l.UVIndex = 10.5
+
+	qc := clearSkyCheck(l, loc)
+	a.True(qc.passed, "Plausible values pass clear-sky check")
+
+	l.SolarRad = 1800
+	qc = clearSkyCheck(l, loc)
+	a.False(qc.passed, "Solar radiation well above clear-sky fails")
+	a.True(qc.failed(ruleClearSky))
+
+	qc = clearSkyCheck(l, location{})
+	a.True(qc.passed, "No location skips clear-sky check")
+
+	// Archive records check the whole interval
+	rec := data.Archive{}
+	rec.Timestamp = time.Date(2016, time.June, 21, 1, 0, 0, 0, time.UTC)
+	rec.SolarRad = 400
+	qc = archiveClearSkyCheck(rec, nil, loc)
+	a.False(qc.passed, "Solar radiation after sunset fails")
+	prev := data.Archive{}
+	prev.Timestamp = rec.Timestamp.Add(-2 * time.Hour)
+	qc = archiveClearSkyCheck(rec, []data.Archive{prev}, loc)
+	a.True(qc.passed, "Long interval including daylight passes")
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// Streaming archive record exports for spreadsheets and data analysis.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+)
+
+// Archive record formats.
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson" // Newline-delimited JSON
+)
+
+// formatTypes are the content types of the archive record formats.
+var formatTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatNDJSON: "application/x-ndjson",
+}
+
+// acceptFormats are the formats of the accepted media types.
+var acceptFormats = map[string]string{
+	"application/json":     formatJSON,
+	"text/csv":             formatCSV,
+	"application/ndjson":   formatNDJSON,
+	"application/x-ndjson": formatNDJSON,
+}
+
+// archiveFormat returns the requested archive record format from the format
+// query parameter or, if there isn't one, the supported media type with the
+// highest quality value in the Accept header.  Media types with a quality of
+// zero are not acceptable.  The default is JSON.
+func archiveFormat(r *http.Request) (string, error) {
+	if f := strings.ToLower(r.URL.Query().Get("format")); f != "" {
+		if _, ok := formatTypes[f]; !ok {
+			return "", fmt.Errorf("unknown format %q", f)
+		}
+		return f, nil
+	}
+
+	format, best := formatJSON, 0.0
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, params, err := mime.ParseMediaType(a)
+		if err != nil {
+			continue
+		}
+		f, ok := acceptFormats[t]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		// Ties go to the first listed.
+		if q > best {
+			format, best = f, q
+		}
+	}
+
+	return format, nil
+}
+
+// archiveColumns are the CSV columns by their archive record JSON names.
+// Arrays of optional sensors are split into a column per sensor.
+var archiveColumns = []struct {
+	field string
+	n     int // Array length
+}{
+	{"timestamp", 0},
+	{"barometer", 0},
+	{"ET", 0},
+	{"extraHumidity", 2},
+	{"extraTemperature", 3},
+	{"forecast", 0},
+	{"insideHumidity", 0},
+	{"insideTemperature", 0},
+	{"leafTemperature", 2},
+	{"leafWetness", 2},
+	{"outsideHumidity", 0},
+	{"outsideTemperature", 0},
+	{"outsideTemperatureHigh", 0},
+	{"outsideTemperatureLow", 0},
+	{"rainAccumulation", 0},
+	{"rainRateHigh", 0},
+	{"soilMoisture", 4},
+	{"soilTemperature", 4},
+	{"solarRadiation", 0},
+	{"solarRadiationHigh", 0},
+	{"UVIndexAverage", 0},
+	{"UVIndexHigh", 0},
+	{"windDirectionHigh", 0},
+	{"windDirectionPrevailing", 0},
+	{"windSamples", 0},
+	{"windSpeedAverage", 0},
+	{"windSpeedHigh", 0},
+	{"qualityFlags", 0},
+}
+
+// csvValue formats a generic JSON value as a CSV field.  Missing optional
+// sensors are empty and quality flags are "field:rule" pairs separated by
+// semicolons.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	case map[string]interface{}:
+		flags := make([]string, 0, len(v))
+		for f, rule := range v {
+			flags = append(flags, fmt.Sprintf("%s:%v", f, rule))
+		}
+		sort.Strings(flags)
+		return strings.Join(flags, ";")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// archiveEncoder writes archive records one at a time.
+type archiveEncoder interface {
+	encode(archive.Record) error
+	flush() error
+}
+
+// csvEncoder writes archive records as CSV rows after a header row.
+type csvEncoder struct {
+	w      *csv.Writer
+	u      unitSystem
+	header bool
+}
+
+func (e *csvEncoder) encode(rec archive.Record) error {
+	if !e.header {
+		var row []string
+		for _, c := range archiveColumns {
+			if c.n < 1 {
+				row = append(row, c.field)
+			}
+			for i := 0; i < c.n; i++ {
+				row = append(row, fmt.Sprintf("%s[%d]", c.field, i))
+			}
+		}
+		if err := e.w.Write(row); err != nil {
+			return err
+		}
+		e.header = true
+	}
+
+	b, err := e.u.marshal(rec)
+	if err != nil {
+		return err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return err
+	}
+
+	var row []string
+	for _, c := range archiveColumns {
+		if c.n < 1 {
+			row = append(row, csvValue(m[c.field]))
+		}
+		a, _ := m[c.field].([]interface{})
+		for i := 0; i < c.n; i++ {
+			var v interface{}
+			if i < len(a) {
+				v = a[i]
+			}
+			row = append(row, csvValue(v))
+		}
+	}
+
+	return e.w.Write(row)
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ndjsonEncoder writes archive records as newline-delimited JSON.
+type ndjsonEncoder struct {
+	w io.Writer
+	u unitSystem
+}
+
+func (e ndjsonEncoder) encode(rec archive.Record) error {
+	b, err := e.u.marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(b, '\n'))
+
+	return err
+}
+
+func (ndjsonEncoder) flush() error { return nil }
+
+// newArchiveEncoder returns an encoder for a streaming format.
+func newArchiveEncoder(w io.Writer, format string, u unitSystem) archiveEncoder {
+	if format == formatCSV {
+		return &csvEncoder{w: csv.NewWriter(w), u: u}
+	}
+
+	return ndjsonEncoder{w: w, u: u}
+}
+
+// exportArchive streams archive records to the client as they're read from
+// the database rather than building the entire response in memory, so
+// there's no limit on the duration.  If the client goes away the caller
+// cancels the iteration.
+func exportArchive(w http.ResponseWriter, ac <-chan archive.Record, format string, u unitSystem) {
+	rec, ok := <-ac
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", formatTypes[format])
+	e := newArchiveEncoder(w, format, u)
+	for ; ok; rec, ok = <-ac {
+		if e.encode(rec) != nil {
+			return
+		}
+	}
+	e.flush()
+}
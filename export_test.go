@@ -0,0 +1,97 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveFormat(t *testing.T) {
+	a := assert.New(t)
+
+	format := func(query, accept string) (string, error) {
+		r := httptest.NewRequest("GET", "/archive"+query, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		return archiveFormat(r)
+	}
+
+	f, err := format("", "")
+	a.Nil(err)
+	a.Equal(formatJSON, f)
+
+	f, _ = format("", "text/html, text/csv;q=0.9, */*")
+	a.Equal(formatCSV, f)
+	f, _ = format("", "application/x-ndjson")
+	a.Equal(formatNDJSON, f)
+	f, _ = format("", "text/csv;q=0.5, application/x-ndjson;q=0.8")
+	a.Equal(formatNDJSON, f, "Highest quality is preferred")
+	f, _ = format("", "application/ndjson, text/csv")
+	a.Equal(formatNDJSON, f, "Ties go to the first listed")
+	f, _ = format("", "text/csv;q=0")
+	a.Equal(formatJSON, f, "Zero quality isn't acceptable")
+	f, _ = format("", "text/csv;q=0, application/x-ndjson;q=0.1")
+	a.Equal(formatNDJSON, f)
+	f, _ = format("?format=NDJSON", "text/csv")
+	a.Equal(formatNDJSON, f, "Query parameter overrides Accept")
+
+	_, err = format("?format=xml", "")
+	a.NotNil(err)
+}
+
+func testRecords(recs ...archive.Record) <-chan archive.Record {
+	ac := make(chan archive.Record, len(recs))
+	for _, rec := range recs {
+		ac <- rec
+	}
+	close(ac)
+
+	return ac
+}
+
+func TestExportArchive(t *testing.T) {
+	a := assert.New(t)
+
+	var rec1, rec2 archive.Record
+	rec1.Timestamp = time.Date(2016, time.June, 1, 12, 5, 0, 0, time.UTC)
+	rec1.OutTemp = 212.0
+	soil := 32
+	rec1.SoilTemp[1] = &soil
+	rec2.Timestamp = time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+	rec2.Flags = map[string]string{"outsideTemperature": "range", "barometer": "temporal"}
+
+	w := httptest.NewRecorder()
+	exportArchive(w, testRecords(rec1, rec2), formatCSV, unitSystems["metric"])
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	a.Len(lines, 3)
+	a.True(strings.HasPrefix(lines[0], "timestamp,barometer,ET,extraHumidity[0],extraHumidity[1],"))
+	a.Contains(lines[0], ",soilTemperature[0],soilTemperature[1],soilTemperature[2],soilTemperature[3],")
+	a.True(strings.HasSuffix(lines[0], ",qualityFlags"))
+	a.True(strings.HasPrefix(lines[1], "2016-06-01T12:05:00Z,"))
+	a.Contains(lines[1], ",100,")
+	a.Contains(lines[1], ",,0,,,")
+	a.True(strings.HasSuffix(lines[2], ",barometer:temporal;outsideTemperature:range"))
+
+	w = httptest.NewRecorder()
+	exportArchive(w, testRecords(rec2), formatNDJSON, imperial)
+	a.Equal("application/x-ndjson", w.Header().Get("Content-Type"))
+	lines = strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	a.Len(lines, 1)
+	a.Contains(lines[0], `"timestamp":"2016-06-01T12:00:00Z"`)
+
+	w = httptest.NewRecorder()
+	exportArchive(w, testRecords(), formatNDJSON, imperial)
+	a.Equal(http.StatusNoContent, w.Code)
+}
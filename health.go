@@ -0,0 +1,133 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// Machine-readable server and station health.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ebarkie/weatherlink/data"
+)
+
+// The longest console archive interval is 2 hours so records older than
+// that, with a little margin, mean archiving stopped.
+const archiveStaleAge = 2*time.Hour + 15*time.Minute
+
+// Health statuses.
+const (
+	healthPass = "pass" // Everything is working
+	healthWarn = "warn" // Working but something needs attention
+	healthFail = "fail" // Not working
+)
+
+// healthLoops is the state of the loop packets.
+type healthLoops struct {
+	Count     int        `json:"count"`
+	Min       int        `json:"minimum"`
+	Timestamp *time.Time `json:"lastTimestamp,omitempty"`
+	Age       *int64     `json:"age,omitempty"` // Seconds
+	MaxAge    int64      `json:"maximumAge"`    // Seconds
+}
+
+// healthArchive is the state of the archive records.
+type healthArchive struct {
+	Timestamp *time.Time `json:"lastTimestamp,omitempty"`
+	Age       *int64     `json:"age,omitempty"` // Seconds
+	MaxAge    int64      `json:"maximumAge"`    // Seconds
+}
+
+// healthFirmware is the console firmware.
+type healthFirmware struct {
+	BuildTime time.Time `json:"buildTime"`
+	Version   string    `json:"version"`
+}
+
+// health is the overall health of the server and station.
+type health struct {
+	Status    string         `json:"status"`
+	Problems  []string       `json:"problems"`
+	Loops     healthLoops    `json:"loops"`
+	Archive   healthArchive  `json:"archive"`
+	Battery   *data.LoopBat  `json:"battery,omitempty"`
+	Stuck     []stuckSensor  `json:"stuckSensors"`
+	Firmware  healthFirmware `json:"firmware"`
+	StartTime time.Time      `json:"startTime"`
+	Uptime    int64          `json:"uptime"` // Seconds
+}
+
+// degrade lowers the health status, if necessary, and adds the problem.
+func (h *health) degrade(status string, problem string) {
+	if status == healthFail || h.Status == healthPass {
+		h.Status = status
+	}
+	h.Problems = append(h.Problems, problem)
+}
+
+// checkHealth determines the health as of time now from the loop buffer
+// state, the timestamp of the last archive record, and the stuck sensors.
+func checkHealth(now time.Time, numLoops int, lastLoop loop, lastArchive time.Time, stuck []stuckSensor) (h health) {
+	h.Status = healthPass
+	h.Problems = []string{}
+	h.Stuck = stuck
+	if h.Stuck == nil {
+		h.Stuck = []stuckSensor{}
+	}
+
+	// Loop packets are required for everything else to work.
+	h.Loops = healthLoops{
+		Count:  numLoops,
+		Min:    loopsMin,
+		MaxAge: int64(loopStaleAge / time.Second),
+	}
+	if numLoops > 0 {
+		age := int64(now.Sub(lastLoop.Timestamp) / time.Second)
+		h.Loops.Timestamp, h.Loops.Age = &lastLoop.Timestamp, &age
+
+		bat := lastLoop.Bat
+		h.Battery = &bat
+	}
+	switch {
+	case numLoops < loopsMin:
+		h.degrade(healthFail, errLoopsMin.Error())
+	case now.Sub(lastLoop.Timestamp) > loopStaleAge:
+		h.degrade(healthFail, errLoopsAge.Error())
+	}
+
+	// Archive records stopping only affects history.
+	h.Archive = healthArchive{MaxAge: int64(archiveStaleAge / time.Second)}
+	if !lastArchive.IsZero() {
+		age := int64(now.Sub(lastArchive) / time.Second)
+		h.Archive.Timestamp, h.Archive.Age = &lastArchive, &age
+	}
+	if now.Sub(lastArchive) > archiveStaleAge {
+		h.degrade(healthWarn, "archive records are too old")
+	}
+
+	if h.Battery != nil {
+		for _, t := range h.Battery.TransLow {
+			h.degrade(healthWarn, fmt.Sprintf("transmitter %d battery is low", t))
+		}
+	}
+	for _, s := range h.Stuck {
+		h.degrade(healthWarn, fmt.Sprintf("%s is stuck", s.Field))
+	}
+
+	return
+}
+
+// health returns the current health of the server and station.
+func (sc serverCtx) health() health {
+	now := time.Now()
+	numLoops, lastLoop := sc.lb.last()
+
+	h := checkHealth(now, numLoops, lastLoop, sc.ar.Last(), sc.hl.get())
+	h.Firmware = healthFirmware{BuildTime: sc.firmBuildTime, Version: sc.firmVer}
+	h.StartTime = sc.startTime
+	h.Uptime = int64(now.Sub(sc.startTime) / time.Second)
+
+	return h
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckHealth(t *testing.T) {
+	a := assert.New(t)
+
+	now := time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+	l := loop{Timestamp: now.Add(-2 * time.Second)}
+	l.Bat.ConsoleVoltage = 4.7
+
+	// Just started
+	h := checkHealth(now, 0, loop{}, time.Time{}, nil)
+	a.Equal(healthFail, h.Status)
+	a.Equal([]string{errLoopsMin.Error(), "archive records are too old"}, h.Problems)
+	a.Nil(h.Loops.Age)
+	a.Nil(h.Archive.Timestamp)
+	a.Nil(h.Battery)
+	a.NotNil(h.Stuck)
+
+	// Working
+	h = checkHealth(now, loopsMax, l, now.Add(-5*time.Minute), nil)
+	a.Equal(healthPass, h.Status)
+	a.Empty(h.Problems)
+	a.Equal(int64(2), *h.Loops.Age)
+	a.Equal(int64(300), *h.Archive.Age)
+	a.Equal(4.7, h.Battery.ConsoleVoltage)
+
+	// Needs attention
+	l.Bat.TransLow = []int{1}
+	stuck := []stuckSensor{{Field: "outsideHumidity", Value: 100, Since: now.Add(-72 * time.Hour)}}
+	h = checkHealth(now, loopsMax, l, now.Add(-3*time.Hour), stuck)
+	a.Equal(healthWarn, h.Status)
+	a.Equal([]string{
+		"archive records are too old",
+		"transmitter 1 battery is low",
+		"outsideHumidity is stuck",
+	}, h.Problems)
+
+	// Station stopped sending, which is worse than anything else
+	h = checkHealth(now.Add(10*time.Minute), loopsMax, l, now, stuck)
+	a.Equal(healthFail, h.Status)
+	a.Equal(errLoopsAge.Error(), h.Problems[0])
+}
@@ -7,13 +7,20 @@ package main
 // HTTP server for accessing weather station data.
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	//_ "net/http/pprof"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/ebarkie/davis-station/internal/events"
 )
 
 type httpCtx serverCtx
@@ -33,7 +40,18 @@ func (l *httpLogWrapper) WriteHeader(status int) {
 	l.ResponseWriter.WriteHeader(status)
 }
 
-func (httpCtx) logHandler(h http.Handler) http.HandlerFunc {
+// Hijack lets WebSocket upgrades take over the connection.
+func (l *httpLogWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := l.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection doesn't support hijacking")
+	}
+	l.status = http.StatusSwitchingProtocols
+
+	return h.Hijack()
+}
+
+func (c httpCtx) logHandler(h http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		record := &httpLogWrapper{
 			Flusher:        w.(http.Flusher),
@@ -41,8 +59,19 @@ func (httpCtx) logHandler(h http.Handler) http.HandlerFunc {
 			status:         http.StatusOK,
 		}
 
+		start := time.Now()
 		h.ServeHTTP(record, r)
 
+		// Metrics are by registered route so unknown paths don't create
+		// new series.
+		route := "other"
+		if mux, ok := h.(*http.ServeMux); ok {
+			if _, pattern := mux.Handler(r); pattern != "" {
+				route = pattern
+			}
+		}
+		c.ms.request(route, record.status, time.Since(start))
+
 		msg := fmt.Sprintf("HTTP connection from %s request %s %s response %d", r.RemoteAddr, r.Method, r.URL, record.status)
 		if record.status < 299 {
 			Debug.Println(msg)
@@ -52,18 +81,14 @@ func (httpCtx) logHandler(h http.Handler) http.HandlerFunc {
 	}
 }
 
-// archive is the endpoint for serving out archive records.
-// GET /archive[?begin=2016-08-03T00:00:00Z][&end=2016-09-03T00:00:00Z]
-func (c httpCtx) archive(w http.ResponseWriter, r *http.Request) {
-	// Parse and validate begin and end parameters
-	var begin, end time.Time
-	var err error
-
+// timeRange parses and validates the begin and end query parameters.  If
+// end is not specified it defaults to now and if begin is not specified
+// it's calculated by the since function.
+func timeRange(r *http.Request, since func(time.Time) time.Time) (begin, end time.Time, err error) {
 	if r.URL.Query().Get("end") != "" {
 		end, err = time.Parse(time.RFC3339, r.URL.Query().Get("end"))
 		if err != nil {
-			w.Header().Set("Warning", "Unable to parse end timestamp")
-			w.WriteHeader(http.StatusBadRequest)
+			err = errors.New("Unable to parse end timestamp")
 			return
 		}
 	} else {
@@ -73,19 +98,110 @@ func (c httpCtx) archive(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("begin") != "" {
 		begin, err = time.Parse(time.RFC3339, r.URL.Query().Get("begin"))
 		if err != nil {
-			w.Header().Set("Warning", "Unable to parse begin timestamp")
-			w.WriteHeader(http.StatusBadRequest)
+			err = errors.New("Unable to parse begin timestamp")
 			return
 		}
 	} else {
-		begin = end.AddDate(0, 0, -1)
+		begin = since(end)
 	}
 
 	if end.Before(begin) {
-		w.Header().Set("Warning", "End timestamp precedes begin timestamp")
+		err = errors.New("End timestamp precedes begin timestamp")
+	}
+
+	return
+}
+
+// writeJSON writes loops or archive records as JSON in the requested unit
+// system.
+func writeJSON(w http.ResponseWriter, u unitSystem, v interface{}) {
+	b, err := u.marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// archive is the endpoint for serving out archive records.
+// GET /archive[?begin=2016-08-03T00:00:00Z][&end=2016-09-03T00:00:00Z][&suspect=true|false][&order=desc|asc][&limit=#][&units=imperial|metric|si][&format=json|csv|ndjson]
+func (c httpCtx) archive(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate begin and end parameters
+	begin, end, err := timeRange(r, func(end time.Time) time.Time {
+		return end.AddDate(0, 0, -1)
+	})
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Parse and validate the optional suspect parameter which filters
+	// on whether records failed quality control.
+	var suspect *bool
+	if r.URL.Query().Get("suspect") != "" {
+		b, err := strconv.ParseBool(r.URL.Query().Get("suspect"))
+		if err != nil {
+			w.Header().Set("Warning", "Unable to parse suspect filter")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		suspect = &b
+	}
+
+	// Parse and validate the optional order and limit parameters.  The
+	// default is newest first with no limit.
+	q := archive.Query{Begin: begin, End: end}
+	switch strings.ToLower(r.URL.Query().Get("order")) {
+	case "", "desc":
+	case "asc":
+		q.Order = archive.Ascending
+	default:
+		w.Header().Set("Warning", "Unable to parse order")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("limit") != "" {
+		q.Limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || q.Limit < 0 {
+			w.Header().Set("Warning", "Unable to parse limit")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if suspect != nil {
+		q.Filter = func(rec archive.Record) bool {
+			return rec.Suspect() == *suspect
+		}
+	}
+
+	u, err := unitsQuery(r.URL.Query())
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	format, err := archiveFormat(r)
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	w.Header().Set("Vary", "Accept")
+
+	// Stop reading from the database if the client goes away.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// CSV and newline-delimited JSON are streamed so any duration is
+	// allowed.
+	if format != formatJSON {
+		exportArchive(w, c.ar.Iter(ctx, q), format, u)
+		return
+	}
 
 	// Large durations can be very resource intensive to marshal so
 	// cap at 30 days.
@@ -96,18 +212,40 @@ func (c httpCtx) archive(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query archive from database and return
-	archive := c.ar.Get(begin, end)
-	if len(archive) < 1 {
+	var recs []archive.Record
+	for rec := range c.ar.Iter(ctx, q) {
+		recs = append(recs, rec)
+	}
+	if len(recs) < 1 {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
+	writeJSON(w, u, recs)
+}
+
+// health is the endpoint for serving out server and station health.  If
+// the server isn't working a HTTP service unavailable response is sent.
+// GET /health
+func (c httpCtx) health(w http.ResponseWriter, r *http.Request) {
+	h := serverCtx(c).health()
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(archive)
+	if h.Status == healthFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
 }
 
 // loop is the endpoint for serving out loop samples.
-// GET /loop[?lastSequence=#]
+// GET /loop[?lastSequence=#][&units=imperial|metric|si]
 func (c httpCtx) loop(w http.ResponseWriter, r *http.Request) {
+	u, err := unitsQuery(r.URL.Query())
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	numLoops, lastLoop := c.lb.last()
 
 	// If there aren't enough samples (the server just started) or
@@ -127,7 +265,6 @@ func (c httpCtx) loop(w http.ResponseWriter, r *http.Request) {
 
 	// Figure out if request is for loops since a sequence or just for
 	// most recent loop.
-	j := json.NewEncoder(w)
 	if r.URL.Query().Get("lastSequence") != "" {
 		seq, _ := strconv.ParseInt(r.URL.Query().Get("lastSequence"), 10, 64)
 
@@ -147,62 +284,356 @@ func (c httpCtx) loop(w http.ResponseWriter, r *http.Request) {
 			if endIndex > numLoops {
 				endIndex = numLoops
 			}
-			w.Header().Set("Content-Type", "application/json")
-			j.Encode(c.lb.loops()[0:endIndex])
+			writeJSON(w, u, c.lb.loops()[0:endIndex])
 		}
 	} else {
-		w.Header().Set("Content-Type", "application/json")
-		j.Encode(lastLoop)
+		writeJSON(w, u, lastLoop)
 	}
 }
 
 // events is the endpoint for streaming loop samples using the Server-sent
 // events.
-// GET /events
+// GET /events[?events=loop,archive][&units=imperial|metric|si]
 func (c httpCtx) events(w http.ResponseWriter, r *http.Request) {
 	// See Server-sent-event specification:
 	// https://en.wikipedia.org/wiki/Server-sent_events
 
+	// Optional comma separated list of event names to receive, with
+	// wildcard support.  The default is all events.
+	topics, err := events.Topics(r.URL.Query().Get("events"))
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u, err := unitsQuery(r.URL.Query())
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	events := c.eb.Subscribe(r.RemoteAddr)
-	defer c.eb.Unsubscribe(events)
+	ec := c.eb.Subscribe(r.RemoteAddr, topics...)
+	defer c.eb.Unsubscribe(ec)
+
+	// Hint how quickly to reconnect and, if this is a reconnect, replay
+	// the events that were missed.  Subscribing first and holding live
+	// events while the replay is written ensures nothing is lost in
+	// between, and the cursor skips anything sent twice.
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry/time.Millisecond)
+	cur := newEventCursor(u)
+	var live []events.Event
+	for _, e := range serverCtx(c).replay(r.Header.Get("Last-Event-ID"), topics) {
+		cur.send(w, e)
+		live = hold(ec, live)
+	}
+	for _, e := range live {
+		if !cur.sent(e) {
+			cur.send(w, e)
+		}
+	}
+	w.(http.Flusher).Flush()
 
 	for {
 		select {
 		case <-r.Context().Done():
 			// Client closed the connection
 			return
-		case e := <-events:
-			fmt.Fprintf(w, "event: %s\n", e.Name)
-			r, _ := json.Marshal(e.Data)
-			fmt.Fprintf(w, "data: %s\n\n", r)
+		case e, ok := <-ec:
+			if !ok {
+				select {
+				case <-c.eb.Done():
+					// Server is shutting down
+					fmt.Fprintf(w, ": server shutting down, goodbye\n\n")
+					w.(http.Flusher).Flush()
+				default:
+					// Evicted for falling too far behind.  The client
+					// will reconnect and resume from the last event id.
+					Warn.Printf("Events subscriber %s fell too far behind", r.RemoteAddr)
+				}
+				return
+			}
+			if cur.sent(e) {
+				continue
+			}
+			cur.send(w, e)
 			w.(http.Flusher).Flush()
 		}
 	}
 }
 
+// metrics is the endpoint for serving out Prometheus metrics.
+// GET /metrics
+func (c httpCtx) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	serverCtx(c).metrics(w)
+}
+
+// rejects is the endpoint for serving out loop packets that were rejected
+// by quality control.
+// GET /qc/rejects[?begin=2016-08-03T00:00:00Z][&end=2016-09-03T00:00:00Z]
+func (c httpCtx) rejects(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate begin and end parameters
+	begin, end, err := timeRange(r, func(end time.Time) time.Time {
+		return end.AddDate(0, 0, -1)
+	})
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Query rejects from database and return
+	rejects := c.ar.Rejects(begin, end)
+	if len(rejects) < 1 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rejects)
+}
+
+// metar is the endpoint for serving out the current METAR report.
+// GET /metar
+func (c httpCtx) metar(w http.ResponseWriter, r *http.Request) {
+	numLoops, lastLoop := c.lb.last()
+
+	// If there aren't enough samples (the server just started) or
+	// there were no recent updates then send a HTTP service temporarily
+	// unavailable response.
+	if numLoops < loopsMin {
+		w.Header().Set("Warning", errLoopsMin.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if time.Since(lastLoop.Timestamp) > loopStaleAge {
+		w.Header().Set("Warning", errLoopsAge.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, serverCtx(c).report(lastLoop))
+}
+
+// metars is the endpoint for serving out hourly METAR reports reconstructed
+// from the archive records.
+// GET /metar/history[?begin=2016-08-03T00:00:00Z][&end=2016-09-03T00:00:00Z]
+func (c httpCtx) metars(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate begin and end parameters
+	begin, end, err := timeRange(r, func(end time.Time) time.Time {
+		return end.AddDate(0, 0, -1)
+	})
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Large durations can be very resource intensive to reconstruct so
+	// cap at 30 days.
+	if end.Sub(begin) > (30 * (24 * time.Hour)) {
+		w.Header().Set("Warning", "Duration exceeds maximum allowed")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Query archive from database including the extra day the remarks
+	// summarize and generate a report for each record at the top of the
+	// hour.
+	as := c.ar.Get(begin.Add(-24*time.Hour), end)
+	var reports []string
+	for _, rec := range as {
+		if rec.Timestamp.Before(begin) {
+			break
+		}
+		if rec.Timestamp.After(end) || rec.Timestamp.Minute() != 0 {
+			continue
+		}
+		reports = append(reports, metar(c.stn.ID, archiveLoop(rec, as), nil, as))
+	}
+	if len(reports) < 1 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, s := range reports {
+		fmt.Fprintln(w, s)
+	}
+}
+
+// qcStats is the endpoint for serving out quality control statistics.
+// GET /qc/stats
+func (c httpCtx) qcStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.qs.report(time.Now()))
+}
+
+// speci is the endpoint for serving out the most recent special weather
+// report.
+// GET /speci
+func (c httpCtx) speci(w http.ResponseWriter, r *http.Request) {
+	s, ok := c.ar.LastSpeci()
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// specis is the endpoint for serving out the history of special weather
+// reports.
+// GET /speci/history[?begin=2016-08-03T00:00:00Z][&end=2016-09-03T00:00:00Z]
+func (c httpCtx) specis(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate begin and end parameters
+	begin, end, err := timeRange(r, func(end time.Time) time.Time {
+		return end.AddDate(0, 0, -1)
+	})
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Query reports from database and return
+	specis := c.ar.Specis(begin, end)
+	if len(specis) < 1 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(specis)
+}
+
+// station is the endpoint for serving out the station identification and
+// location.
+// GET /station
+func (c httpCtx) station(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.stn)
+}
+
+// synop is the endpoint for serving out the current SYNOP report.
+// GET /synop
+func (c httpCtx) synop(w http.ResponseWriter, r *http.Request) {
+	numLoops, lastLoop := c.lb.last()
+
+	// If there aren't enough samples (the server just started) or
+	// there were no recent updates then send a HTTP service temporarily
+	// unavailable response.
+	if numLoops < loopsMin {
+		w.Header().Set("Warning", errLoopsMin.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if time.Since(lastLoop.Timestamp) > loopStaleAge {
+		w.Header().Set("Warning", errLoopsAge.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, serverCtx(c).synopReport(lastLoop))
+}
+
+// summary is the endpoint for serving out daily, monthly, or yearly
+// summaries.
+// GET /summary[?period=day|month|year][&begin=2016-08-03T00:00:00Z][&end=2016-09-03T00:00:00Z]
+func (c httpCtx) summary(w http.ResponseWriter, r *http.Request) {
+	p := archive.Day
+	if r.URL.Query().Get("period") != "" {
+		p = archive.Period(r.URL.Query().Get("period"))
+	}
+
+	// Parse and validate begin and end parameters.  The default range
+	// depends on the period.
+	begin, end, err := timeRange(r, func(end time.Time) time.Time {
+		switch p {
+		case archive.Year:
+			return end.AddDate(-10, 0, 0)
+		case archive.Month:
+			return end.AddDate(-1, 0, 0)
+		default:
+			return end.AddDate(0, 0, -7)
+		}
+	})
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Query summaries from database and return
+	summaries, err := c.ar.Summaries(p, begin, end)
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(summaries) < 1 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
 // httpServer starts the HTTP server.
-func httpServer(sc serverCtx, cfg config) {
+func httpServer(ctx context.Context, sc serverCtx, cfg config) {
 	// Inherit generic server context so we have access to things like
 	// archive records and loop packets.
 	c := httpCtx(sc)
 
 	// Register routes
 	http.HandleFunc("/archive", c.archive)
+	http.HandleFunc("/health", c.health)
 	http.HandleFunc("/loop", c.loop)
+	http.HandleFunc("/metar", c.metar)
+	http.HandleFunc("/metar/history", c.metars)
+	http.HandleFunc("/metrics", c.metrics)
 	http.HandleFunc("/events", c.events)
+	http.HandleFunc("/qc/rejects", c.rejects)
+	http.HandleFunc("/qc/stats", c.qcStats)
+	http.HandleFunc("/speci", c.speci)
+	http.HandleFunc("/speci/history", c.specis)
+	http.HandleFunc("/station", c.station)
+	http.HandleFunc("/summary", c.summary)
+	http.HandleFunc("/synop", c.synop)
+	http.HandleFunc("/ws", c.ws)
 
 	// Listen and accept new connections
 	s := http.Server{
 		Addr:    net.JoinHostPort(cfg.addr, "8080"),
 		Handler: c.logHandler(http.DefaultServeMux),
 	}
+	// Stop accepting new connections when the context is done and wait
+	// for the active ones to finish.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := s.Shutdown(sctx)
+		if err != nil {
+			Warn.Printf("HTTP server shutdown error: %s", err.Error())
+		}
+	}()
+
 	Info.Printf("HTTP server started on %s", s.Addr)
 	err := s.ListenAndServe()
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		Error.Fatalf("HTTP server error: %s", err.Error())
 	}
+	<-done
+	Info.Println("HTTP server stopped")
 }
@@ -6,6 +6,7 @@ package archive
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"time"
 
@@ -19,16 +20,43 @@ type Records struct {
 	db *bolt.DB
 }
 
+// Record is an archive record along with the quality flags of any fields
+// that failed quality control.
+type Record struct {
+	data.Archive
+	Flags map[string]string `json:"qualityFlags,omitempty"`
+}
+
+// Suspect returns true if any of the record fields failed quality control.
+func (rec Record) Suspect() bool {
+	return len(rec.Flags) > 0
+}
+
 // Open opens up the archive records database.
 func Open(file string) (r Records, err error) {
 	r.db, err = bolt.Open(file, 0600, nil)
+	if err != nil {
+		return
+	}
+
+	// Seed the summaries if the database predates them.
+	err = r.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(Day.bucket()) != nil {
+			return nil
+		}
+
+		return rebuildSummaries(tx)
+	})
+
 	return
 }
 
-// Add adds an archive record to the database.
-func (r Records) Add(a data.Archive) error {
+// Add adds an archive record to the database and folds it into the
+// summaries.
+func (r Records) Add(rec Record) error {
+	a := rec.Archive
 	return r.db.Update(func(tx *bolt.Tx) error {
-		encoded, err := json.Marshal(a)
+		encoded, err := json.Marshal(rec)
 		if err != nil {
 			return err
 		}
@@ -38,7 +66,49 @@ func (r Records) Add(a data.Archive) error {
 			return err
 		}
 
-		return b.Put([]byte(a.Timestamp.In(time.UTC).Format(time.RFC3339)), encoded)
+		// Find the previous record to determine the interval this one
+		// covers.
+		k := []byte(a.Timestamp.In(time.UTC).Format(time.RFC3339))
+		var prev time.Time
+		c := b.Cursor()
+		pk, _ := c.Seek(k)
+		replaced := bytes.Equal(pk, k)
+		if pk == nil {
+			pk, _ = c.Last()
+		} else {
+			pk, _ = c.Prev()
+		}
+		if pk != nil {
+			prev, _ = time.Parse(time.RFC3339, string(pk))
+		}
+
+		err = b.Put(k, encoded)
+		if err != nil {
+			return err
+		}
+
+		// New records are usually the most recent so they're simply
+		// folded into the summaries.
+		c = b.Cursor()
+		c.Seek(k)
+		nk, nv := c.Next()
+		if !replaced && nk == nil {
+			return addSummaries(tx, rec, interval(prev, a.Timestamp))
+		}
+
+		// Replacing a record, or inserting one before others, changes the
+		// summaries it's in and the interval of the record that follows
+		// so those are recreated.
+		err = resummarize(tx, a.Timestamp)
+		if err != nil || nk == nil {
+			return err
+		}
+		var next Record
+		if json.Unmarshal(nv, &next) != nil || bytes.Equal(Day.key(next.Timestamp), Day.key(a.Timestamp)) {
+			return nil
+		}
+
+		return resummarize(tx, next.Timestamp)
 	})
 }
 
@@ -49,9 +119,8 @@ func (r Records) Close() error {
 
 // Get returns the requested range of archive records as a slice in descending
 // order.
-func (r Records) Get(begin time.Time, end time.Time) (archive []data.Archive) {
-	ac := r.NewGet(begin, end)
-	for a := range ac {
+func (r Records) Get(begin time.Time, end time.Time) (archive []Record) {
+	for a := range r.Iter(context.Background(), Query{Begin: begin, End: end}) {
 		archive = append(archive, a)
 	}
 
@@ -79,41 +148,113 @@ func (r Records) Last() (t time.Time) {
 	return
 }
 
-// NewGet creates a channel and sends the requested range of archive records to it
-// in descending order.
-func (r Records) NewGet(begin time.Time, end time.Time) <-chan data.Archive {
-	ac := make(chan data.Archive)
+// Prev returns the most recent archive record before the specified time.
+// If there isn't one then ok is false.
+func (r Records) Prev(t time.Time) (rec Record, ok bool) {
+	r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("archive"))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		k, v := c.Seek([]byte(t.In(time.UTC).Format(time.RFC3339)))
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		if k != nil {
+			ok = json.Unmarshal(v, &rec) == nil
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// Order is the order archive records are iterated in.
+type Order int
+
+// Orders.
+const (
+	Descending Order = iota // Newest first
+	Ascending               // Oldest first
+)
+
+// Query selects the archive records to iterate over.
+type Query struct {
+	Begin  time.Time
+	End    time.Time
+	Order  Order
+	Limit  int               // Maximum records, 0 for no limit
+	Filter func(Record) bool // Records to keep, nil for all
+}
+
+// Iter creates a channel and sends the archive records selected by the
+// query to it.  The channel is closed after the last record or when the
+// context is done, so callers that stop early must cancel the context to
+// release the database read transaction.
+func (r Records) Iter(ctx context.Context, q Query) <-chan Record {
+	ac := make(chan Record)
 
 	go func() {
 		defer close(ac)
 
 		r.db.View(func(tx *bolt.Tx) error {
 			b := tx.Bucket([]byte("archive"))
-			if b != nil {
-				c := b.Cursor()
+			if b == nil {
+				return nil
+			}
+			c := b.Cursor()
 
-				min := []byte(begin.In(time.UTC).Format(time.RFC3339))
-				max := []byte(end.In(time.UTC).Format(time.RFC3339))
+			min := []byte(q.Begin.In(time.UTC).Format(time.RFC3339))
+			max := []byte(q.End.In(time.UTC).Format(time.RFC3339))
 
-				// Find starting position
-				if k, _ := c.Seek(max); k == nil {
-					// If max is not found then use the last key
-					max, _ = c.Last()
+			var k, v []byte
+			var next func() ([]byte, []byte)
+			var done func([]byte) bool
+			if q.Order == Ascending {
+				k, v = c.Seek(min)
+				next = c.Next
+				done = func(k []byte) bool { return bytes.Compare(k, max) > 0 }
+			} else {
+				// If Seek() does not get an exact match it returns the
+				// next key, which goes beyond max, so start at the key
+				// before it.  If there is no next key then start at the
+				// last key.
+				k, v = c.Seek(max)
+				if k == nil {
+					k, v = c.Last()
 				} else if !bytes.Equal(k, max) {
-					// If Seek() does not get an exact match it returns
-					// the next key.  This goes beyond max so we really
-					// want to start at the key before it.
-					max, _ = c.Prev()
+					k, v = c.Prev()
+				}
+				next = c.Prev
+				done = func(k []byte) bool { return bytes.Compare(k, min) < 0 }
+			}
+
+			var n int
+			for ; k != nil && !done(k); k, v = next() {
+				var rec Record
+				err := json.Unmarshal(v, &rec)
+				if err != nil {
+					// Silently skip corrupt records.
+					continue
+				}
+				if q.Filter != nil && !q.Filter(rec) {
+					continue
+				}
+
+				select {
+				case ac <- rec:
+				case <-ctx.Done():
+					return nil
 				}
 
-				var a data.Archive
-				for k, v := c.Seek(max); k != nil && bytes.Compare(k, min) >= 0; k, v = c.Prev() {
-					err := json.Unmarshal(v, &a)
-					if err != nil {
-						// Silently skip corrupt records.
-						continue
-					}
-					ac <- a
+				n++
+				if q.Limit > 0 && n >= q.Limit {
+					break
 				}
 			}
 
@@ -0,0 +1,88 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRecords(t *testing.T, begin time.Time, n int) Records {
+	r, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	for i := 0; i < n; i++ {
+		var rec Record
+		rec.Timestamp = begin.Add(time.Duration(i) * 5 * time.Minute)
+		rec.OutTemp = float64(i)
+		if i%2 == 1 {
+			rec.Flags = map[string]string{"outsideTemperature": "range"}
+		}
+		if err := r.Add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return r
+}
+
+func temps(ac <-chan Record) (ts []float64) {
+	for rec := range ac {
+		ts = append(ts, rec.OutTemp)
+	}
+
+	return
+}
+
+func TestIter(t *testing.T) {
+	a := assert.New(t)
+
+	begin := time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+	r := testRecords(t, begin, 6)
+	ctx := context.Background()
+	end := begin.Add(time.Hour)
+
+	a.Equal([]float64{5, 4, 3, 2, 1, 0}, temps(r.Iter(ctx, Query{Begin: begin, End: end})))
+	a.Equal([]float64{0, 1, 2, 3, 4, 5}, temps(r.Iter(ctx, Query{Begin: begin, End: end, Order: Ascending})))
+	a.Equal([]float64{3, 2, 1}, temps(r.Iter(ctx, Query{Begin: begin.Add(time.Minute), End: begin.Add(17 * time.Minute)})))
+	a.Equal([]float64{1, 2, 3}, temps(r.Iter(ctx, Query{Begin: begin.Add(time.Minute), End: begin.Add(17 * time.Minute), Order: Ascending})))
+	a.Equal([]float64{0, 1}, temps(r.Iter(ctx, Query{Begin: begin, End: end, Order: Ascending, Limit: 2})))
+	a.Equal([]float64{5, 3, 1}, temps(r.Iter(ctx, Query{Begin: begin, End: end, Filter: Record.Suspect})))
+	a.Equal([]float64{5, 3}, temps(r.Iter(ctx, Query{Begin: begin, End: end, Filter: Record.Suspect, Limit: 2})))
+	a.Empty(temps(r.Iter(ctx, Query{Begin: end, End: end.Add(time.Hour)})))
+	a.Len(r.Get(begin, end), 6)
+}
+
+func TestIterCancel(t *testing.T) {
+	a := assert.New(t)
+
+	begin := time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+	r := testRecords(t, begin, 6)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ac := r.Iter(ctx, Query{Begin: begin, End: begin.Add(time.Hour)})
+	<-ac
+	cancel()
+
+	// Closing the database waits for read transactions so it only returns
+	// if the abandoned iteration released its transaction.
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		a.Fail("Iteration didn't release its transaction after cancel")
+	}
+}
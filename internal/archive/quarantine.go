@@ -0,0 +1,110 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/ebarkie/weatherlink/data"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	maxRejects   = 1000                                  // Number of rejected loop packets to keep
+	rejectFormat = "2006-01-02T15:04:05.000000000Z07:00" // Sortable key format with sub-second resolution
+)
+
+// Reject is a loop packet that was rejected by quality control along with
+// the reasons why.
+type Reject struct {
+	Timestamp time.Time `json:"timestamp"`
+	Errors    []string  `json:"errors"`
+	Loop      data.Loop `json:"loop"`
+}
+
+// Quarantine adds a rejected loop packet to the database.  Only the most
+// recent rejects are kept.
+func (r Records) Quarantine(rej Reject) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		encoded, err := json.Marshal(rej)
+		if err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucketIfNotExists([]byte("quarantine"))
+		if err != nil {
+			return err
+		}
+
+		// The number of rejects is kept as the bucket sequence so the
+		// bucket isn't walked every time.  Databases from before it was
+		// kept are counted once.
+		k := []byte(rej.Timestamp.In(time.UTC).Format(rejectFormat))
+		n := b.Sequence()
+		if b.Get(k) == nil && n > 0 {
+			n++
+		}
+		err = b.Put(k, encoded)
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		if n == 0 {
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				n++
+			}
+		}
+
+		// Purge the oldest rejects
+		for k, _ := c.First(); k != nil && n > maxRejects; k, _ = c.First() {
+			err = c.Delete()
+			if err != nil {
+				return err
+			}
+			n--
+		}
+
+		return b.SetSequence(n)
+	})
+}
+
+// Rejects returns the requested range of rejected loop packets as a slice in
+// descending order.
+func (r Records) Rejects(begin time.Time, end time.Time) (rejects []Reject) {
+	r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("quarantine"))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		min := []byte(begin.In(time.UTC).Format(rejectFormat))
+		max := []byte(end.In(time.UTC).Format(rejectFormat))
+
+		k, v := c.Seek(max)
+		if k == nil {
+			k, v = c.Last()
+		} else if !bytes.Equal(k, max) {
+			k, v = c.Prev()
+		}
+
+		for ; k != nil && bytes.Compare(k, min) >= 0; k, v = c.Prev() {
+			var rej Reject
+			err := json.Unmarshal(v, &rej)
+			if err != nil {
+				// Silently skip corrupt rejects.
+				continue
+			}
+			rejects = append(rejects, rej)
+		}
+
+		return nil
+	})
+
+	return
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestQuarantine(t *testing.T) {
+	a := assert.New(t)
+
+	begin := time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+	at := func(i int) time.Time { return begin.Add(time.Duration(i) * 2500 * time.Millisecond) }
+	r := testRecords(t, begin, 0)
+	r.db.NoSync = true
+
+	count := func() (n int) {
+		r.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket([]byte("quarantine")).Stats().KeyN
+			return nil
+		})
+		return
+	}
+
+	// Fill the quarantine and then some so the oldest are purged.
+	for i := 0; i < maxRejects+5; i++ {
+		err := r.Quarantine(Reject{Timestamp: at(i), Errors: []string{"range check"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Equal(maxRejects, count())
+
+	end := at(maxRejects + 5)
+	rejs := r.Rejects(begin, end)
+	a.Len(rejs, maxRejects)
+	a.True(at(maxRejects+4).Equal(rejs[0].Timestamp), "Newest reject is kept")
+	a.True(at(5).Equal(rejs[len(rejs)-1].Timestamp), "Oldest rejects were purged")
+
+	// Replacing a reject doesn't purge another.
+	err := r.Quarantine(Reject{Timestamp: at(10), Errors: []string{"temporal check"}})
+	a.Nil(err)
+	a.Equal(maxRejects, count())
+	rejs = r.Rejects(at(10), at(10))
+	a.Len(rejs, 1)
+	a.Equal([]string{"temporal check"}, rejs[0].Errors)
+
+	// Sub-second timestamps are kept apart and ranges are inclusive.
+	rejs = r.Rejects(at(6), at(8))
+	a.Len(rejs, 3)
+	a.True(at(8).Equal(rejs[0].Timestamp))
+
+	// Databases from before the count was kept are counted once.
+	r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("quarantine")).SetSequence(0)
+	})
+	err = r.Quarantine(Reject{Timestamp: end})
+	a.Nil(err)
+	a.Equal(maxRejects, count())
+	a.Empty(r.Rejects(begin, at(5)))
+}
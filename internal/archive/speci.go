@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Speci is a special weather report that was generated because of a
+// significant change in the weather.
+type Speci struct {
+	Timestamp time.Time `json:"timestamp"`
+	Report    string    `json:"report"`
+	Reasons   []string  `json:"reasons"`
+}
+
+// AddSpeci adds a special weather report to the database.
+func (r Records) AddSpeci(s Speci) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		encoded, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucketIfNotExists([]byte("speci"))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(s.Timestamp.In(time.UTC).Format(time.RFC3339)), encoded)
+	})
+}
+
+// Specis returns the requested range of special weather reports as a slice
+// in descending order.
+func (r Records) Specis(begin time.Time, end time.Time) (specis []Speci) {
+	r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("speci"))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		min := []byte(begin.In(time.UTC).Format(time.RFC3339))
+		max := []byte(end.In(time.UTC).Format(time.RFC3339))
+
+		k, v := c.Seek(max)
+		if k == nil {
+			k, v = c.Last()
+		} else if !bytes.Equal(k, max) {
+			k, v = c.Prev()
+		}
+
+		for ; k != nil && bytes.Compare(k, min) >= 0; k, v = c.Prev() {
+			var s Speci
+			err := json.Unmarshal(v, &s)
+			if err != nil {
+				// Silently skip corrupt reports.
+				continue
+			}
+			specis = append(specis, s)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// LastSpeci returns the most recent special weather report.  If there
+// isn't one then ok is false.
+func (r Records) LastSpeci() (s Speci, ok bool) {
+	r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("speci"))
+		if b == nil {
+			return nil
+		}
+
+		if k, v := b.Cursor().Last(); k != nil {
+			ok = json.Unmarshal(v, &s) == nil
+		}
+
+		return nil
+	})
+
+	return
+}
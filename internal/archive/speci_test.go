@@ -0,0 +1,46 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpecis(t *testing.T) {
+	a := assert.New(t)
+
+	begin := time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+	at := func(m int) time.Time { return begin.Add(time.Duration(m) * time.Minute) }
+	r := testRecords(t, begin, 0)
+
+	_, ok := r.LastSpeci()
+	a.False(ok, "No reports yet")
+	a.Empty(r.Specis(at(0), at(60)))
+
+	for _, m := range []int{20, 0, 10, 30} {
+		err := r.AddSpeci(Speci{Timestamp: at(m), Report: "SPECI", Reasons: []string{"WSHFT"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, ok := r.LastSpeci()
+	a.True(ok)
+	a.True(at(30).Equal(s.Timestamp), "Most recent report")
+
+	// Ranges are inclusive and in descending order.
+	ss := r.Specis(at(10), at(20))
+	if a.Len(ss, 2) {
+		a.True(at(20).Equal(ss[0].Timestamp))
+		a.True(at(10).Equal(ss[1].Timestamp))
+		a.Equal([]string{"WSHFT"}, ss[0].Reasons)
+	}
+	a.Len(r.Specis(at(-60), at(60)), 4)
+	a.Len(r.Specis(at(5), at(15)), 1)
+	a.Empty(r.Specis(at(31), at(60)))
+}
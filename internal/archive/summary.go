@@ -0,0 +1,483 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Period is a summary rollup period.
+type Period string
+
+// Summary periods.
+const (
+	Day   Period = "day"
+	Month Period = "month"
+	Year  Period = "year"
+)
+
+// Periods is the list of all summary periods.
+var Periods = []Period{Day, Month, Year}
+
+// Errors.
+var (
+	ErrPeriod = errors.New("unknown summary period")
+)
+
+const (
+	defaultInterval = 5 * time.Minute // Assumed archive interval if it can't be determined
+	maxInterval     = 2 * time.Hour   // Largest archive interval the console supports
+)
+
+// bucket returns the database bucket name for the period.
+func (p Period) bucket() []byte {
+	return []byte("summary-" + string(p))
+}
+
+// begin returns the beginning of the period containing t.
+func (p Period) begin(t time.Time) time.Time {
+	switch p {
+	case Year:
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	case Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+}
+
+// key returns the database key of the period containing t.  Keys sort
+// in chronological order.
+func (p Period) key(t time.Time) []byte {
+	switch p {
+	case Year:
+		return []byte(t.Format("2006"))
+	case Month:
+		return []byte(t.Format("2006-01"))
+	default:
+		return []byte(t.Format("2006-01-02"))
+	}
+}
+
+// valid returns true if the period is known.
+func (p Period) valid() bool {
+	for _, v := range Periods {
+		if p == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Stat is the minimum, maximum, and mean of an observation over a
+// period.
+type Stat struct {
+	Min     float64   `json:"min"`
+	MinTime time.Time `json:"minTimestamp"`
+	Max     float64   `json:"max"`
+	MaxTime time.Time `json:"maxTimestamp"`
+	Mean    float64   `json:"mean"`
+	Samples int       `json:"samples"`
+}
+
+// add folds an observation into the stat.  The low and high values may
+// differ from the mean value for observations where the archive record
+// tracks them separately.
+func (s *Stat) add(t time.Time, mean, low, high float64) {
+	s.Samples++
+	if s.Samples == 1 || low < s.Min {
+		s.Min, s.MinTime = low, t
+	}
+	if s.Samples == 1 || high > s.Max {
+		s.Max, s.MaxTime = high, t
+	}
+	s.Mean += (mean - s.Mean) / float64(s.Samples)
+}
+
+// merge folds the stat of a later part of the period into this one.
+func (s *Stat) merge(o Stat) {
+	if o.Samples < 1 {
+		return
+	}
+	if s.Samples < 1 || o.Min < s.Min {
+		s.Min, s.MinTime = o.Min, o.MinTime
+	}
+	if s.Samples < 1 || o.Max > s.Max {
+		s.Max, s.MaxTime = o.Max, o.MaxTime
+	}
+	s.Samples += o.Samples
+	s.Mean += (o.Mean - s.Mean) * float64(o.Samples) / float64(s.Samples)
+}
+
+// Summary is a rollup of all the archive records within a period.
+type Summary struct {
+	Period  Period    `json:"period"`
+	Begin   time.Time `json:"begin"`
+	Records int       `json:"records"`
+	Last    time.Time `json:"last"`
+
+	Bar         Stat `json:"barometer"`
+	InHumidity  Stat `json:"insideHumidity"`
+	InTemp      Stat `json:"insideTemperature"`
+	OutHumidity Stat `json:"outsideHumidity"`
+	OutTemp     Stat `json:"outsideTemperature"`
+	SolarRad    Stat `json:"solarRadiation"`
+	UVIndex     Stat `json:"UVIndex"`
+	WindSpeed   Stat `json:"windSpeed"`
+
+	ET             float64   `json:"ET"`
+	RainAccum      float64   `json:"rainAccumulation"`
+	RainRateHi     float64   `json:"rainRateHigh"`
+	RainRateHiTime time.Time `json:"rainRateHighTimestamp"`
+	WindDirHi      int       `json:"windDirectionHigh"`
+	WindDirPrevail int       `json:"windDirectionPrevailing"`
+	WindDirs       [16]int   `json:"windDirections"`
+	WindRun        float64   `json:"windRun"`
+}
+
+// add folds an archive record into the summary.  The interval is the
+// time the record covers and is used for calculating wind run.  Fields
+// that failed quality control are left out.
+func (s *Summary) add(rec Record, interval time.Duration) {
+	s.Records++
+	s.Last = rec.Timestamp
+	a, t := rec.Archive, rec.Timestamp
+	ok := func(fields ...string) bool {
+		for _, f := range fields {
+			if _, flagged := rec.Flags[f]; flagged {
+				return false
+			}
+		}
+		return true
+	}
+
+	if ok("barometer") {
+		s.Bar.add(t, a.Bar, a.Bar, a.Bar)
+	}
+	if ok("insideHumidity") {
+		s.InHumidity.add(t, float64(a.InHumidity), float64(a.InHumidity), float64(a.InHumidity))
+	}
+	if ok("insideTemperature") {
+		s.InTemp.add(t, a.InTemp, a.InTemp, a.InTemp)
+	}
+	if ok("outsideHumidity") {
+		s.OutHumidity.add(t, float64(a.OutHumidity), float64(a.OutHumidity), float64(a.OutHumidity))
+	}
+	if ok("outsideTemperature", "outsideTemperatureLow", "outsideTemperatureHigh") {
+		s.OutTemp.add(t, a.OutTemp, a.OutTempLow, a.OutTempHi)
+	}
+	if ok("solarRadiation", "solarRadiationHigh") {
+		s.SolarRad.add(t, float64(a.SolarRad), float64(a.SolarRad), float64(a.SolarRadHi))
+	}
+	if ok("UVIndexAverage", "UVIndexHigh") {
+		s.UVIndex.add(t, a.UVIndexAvg, a.UVIndexAvg, a.UVIndexHi)
+	}
+	if ok("ET") {
+		s.ET += a.ET
+	}
+	if ok("rainAccumulation") {
+		s.RainAccum += a.RainAccum
+	}
+	if ok("rainRateHigh") && (s.RainRateHiTime.IsZero() || a.RainRateHi > s.RainRateHi) {
+		s.RainRateHi, s.RainRateHiTime = a.RainRateHi, t
+	}
+
+	if !ok("windSpeedAverage", "windSpeedHigh", "windDirectionHigh", "windDirectionPrevailing") {
+		return
+	}
+
+	if s.WindSpeed.Samples == 0 || float64(a.WindSpeedHi) > s.WindSpeed.Max {
+		s.WindDirHi = a.WindDirHi
+	}
+	s.WindSpeed.add(t, float64(a.WindSpeedAvg), float64(a.WindSpeedAvg), float64(a.WindSpeedHi))
+
+	// Prevailing direction is the most frequent of the 16 compass
+	// points, weighted by the number of wind samples.  Calm intervals
+	// don't have a meaningful direction so they're skipped.
+	if a.WindSpeedAvg > 0 {
+		w := a.WindSamples
+		if w < 1 {
+			w = 1
+		}
+		s.WindDirs[int(float64(a.WindDirPrevail)/22.5+0.5)%16] += w
+		s.prevail()
+	}
+
+	// Wind run is in miles since wind speeds are in miles per hour.
+	s.WindRun += float64(a.WindSpeedAvg) * interval.Hours()
+}
+
+// prevail sets the prevailing wind direction from the direction counts.
+func (s *Summary) prevail() {
+	max := 0
+	for i, v := range s.WindDirs {
+		if v > s.WindDirs[max] {
+			max = i
+		}
+	}
+	s.WindDirPrevail = int(float64(max)*22.5 + 0.5)
+}
+
+// merge folds the summary of a later, shorter period into this one.
+func (s *Summary) merge(o Summary) {
+	if o.Records < 1 {
+		return
+	}
+	s.Records += o.Records
+	if o.Last.After(s.Last) {
+		s.Last = o.Last
+	}
+
+	s.Bar.merge(o.Bar)
+	s.InHumidity.merge(o.InHumidity)
+	s.InTemp.merge(o.InTemp)
+	s.OutHumidity.merge(o.OutHumidity)
+	s.OutTemp.merge(o.OutTemp)
+	s.SolarRad.merge(o.SolarRad)
+	s.UVIndex.merge(o.UVIndex)
+
+	s.ET += o.ET
+	s.RainAccum += o.RainAccum
+	if !o.RainRateHiTime.IsZero() && (s.RainRateHiTime.IsZero() || o.RainRateHi > s.RainRateHi) {
+		s.RainRateHi, s.RainRateHiTime = o.RainRateHi, o.RainRateHiTime
+	}
+
+	if o.WindSpeed.Samples > 0 && (s.WindSpeed.Samples < 1 || o.WindSpeed.Max > s.WindSpeed.Max) {
+		s.WindDirHi = o.WindDirHi
+	}
+	s.WindSpeed.merge(o.WindSpeed)
+	for i, v := range o.WindDirs {
+		s.WindDirs[i] += v
+	}
+	s.prevail()
+	s.WindRun += o.WindRun
+}
+
+// addSummaries folds an archive record into each of the period summaries.
+func addSummaries(tx *bolt.Tx, rec Record, interval time.Duration) error {
+	for _, p := range Periods {
+		b, err := tx.CreateBucketIfNotExists(p.bucket())
+		if err != nil {
+			return err
+		}
+
+		s := Summary{Period: p, Begin: p.begin(rec.Timestamp)}
+		k := p.key(rec.Timestamp)
+		if v := b.Get(k); v != nil {
+			err = json.Unmarshal(v, &s)
+			if err != nil {
+				return err
+			}
+		}
+
+		s.add(rec, interval)
+
+		encoded, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		err = b.Put(k, encoded)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// interval returns the time covered by an archive record given the
+// timestamp of the record before it.
+func interval(prev, cur time.Time) time.Duration {
+	d := cur.Sub(prev)
+	if prev.IsZero() || d <= 0 || d > maxInterval {
+		return defaultInterval
+	}
+
+	return d
+}
+
+// putSummary stores a period summary, or removes it if there are no
+// records left in the period.
+func putSummary(tx *bolt.Tx, s Summary) error {
+	b, err := tx.CreateBucketIfNotExists(s.Period.bucket())
+	if err != nil {
+		return err
+	}
+
+	k := s.Period.key(s.Begin)
+	if s.Records < 1 {
+		return b.Delete(k)
+	}
+
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(k, encoded)
+}
+
+// summarizeDay recreates the day summary containing t from the archive
+// records.
+func summarizeDay(tx *bolt.Tx, t time.Time) error {
+	s := Summary{Period: Day, Begin: Day.begin(t)}
+	key := Day.key(t)
+
+	b := tx.Bucket([]byte("archive"))
+	if b == nil {
+		return putSummary(tx, s)
+	}
+	min := []byte(s.Begin.In(time.UTC).Format(time.RFC3339))
+	max := []byte(s.Begin.AddDate(0, 0, 1).In(time.UTC).Format(time.RFC3339))
+
+	// The record before the day determines the interval of the first
+	// one.
+	var prev time.Time
+	c := b.Cursor()
+	k, _ := c.Seek(min)
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	if k != nil {
+		prev, _ = time.Parse(time.RFC3339, string(k))
+	}
+
+	k, v := c.Seek(min)
+	for ; k != nil && bytes.Compare(k, max) < 0; k, v = c.Next() {
+		var rec Record
+		err := json.Unmarshal(v, &rec)
+		if err != nil {
+			// Silently skip corrupt records.
+			continue
+		}
+		if bytes.Equal(Day.key(rec.Timestamp), key) {
+			s.add(rec, interval(prev, rec.Timestamp))
+		}
+		prev = rec.Timestamp
+	}
+
+	return putSummary(tx, s)
+}
+
+// rollup recreates the summary of period p containing t by merging the
+// summaries of the shorter period sub that make it up.
+func rollup(tx *bolt.Tx, p Period, sub Period, t time.Time) error {
+	s := Summary{Period: p, Begin: p.begin(t)}
+
+	if b := tx.Bucket(sub.bucket()); b != nil {
+		prefix := p.key(t)
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var o Summary
+			err := json.Unmarshal(v, &o)
+			if err != nil {
+				// Silently skip corrupt summaries.
+				continue
+			}
+			s.merge(o)
+		}
+	}
+
+	return putSummary(tx, s)
+}
+
+// resummarize recreates each of the period summaries containing t.  This
+// is used when records are replaced or inserted out of order since the
+// summaries can't be updated incrementally.
+func resummarize(tx *bolt.Tx, t time.Time) error {
+	err := summarizeDay(tx, t)
+	if err != nil {
+		return err
+	}
+	err = rollup(tx, Month, Day, t)
+	if err != nil {
+		return err
+	}
+
+	return rollup(tx, Year, Month, t)
+}
+
+// rebuildSummaries recreates all of the period summaries from the archive
+// records.  This is used to seed summaries for databases that were created
+// before they existed.
+func rebuildSummaries(tx *bolt.Tx) error {
+	for _, p := range Periods {
+		if tx.Bucket(p.bucket()) != nil {
+			err := tx.DeleteBucket(p.bucket())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	b := tx.Bucket([]byte("archive"))
+	if b == nil {
+		return nil
+	}
+
+	var prev time.Time
+	return b.ForEach(func(k, v []byte) error {
+		var rec Record
+		err := json.Unmarshal(v, &rec)
+		if err != nil {
+			// Silently skip corrupt records.
+			return nil
+		}
+
+		err = addSummaries(tx, rec, interval(prev, rec.Timestamp))
+		prev = rec.Timestamp
+
+		return err
+	})
+}
+
+// Summaries returns the period summaries between begin and end as a slice
+// in descending order.
+func (r Records) Summaries(p Period, begin time.Time, end time.Time) (summaries []Summary, err error) {
+	if !p.valid() {
+		err = ErrPeriod
+		return
+	}
+
+	err = r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(p.bucket())
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		min := p.key(begin.Local())
+		max := p.key(end.Local())
+
+		k, v := c.Seek(max)
+		if k == nil {
+			k, v = c.Last()
+		} else if !bytes.Equal(k, max) {
+			k, v = c.Prev()
+		}
+
+		for ; k != nil && bytes.Compare(k, min) >= 0; k, v = c.Prev() {
+			var s Summary
+			err := json.Unmarshal(v, &s)
+			if err != nil {
+				// Silently skip corrupt summaries.
+				continue
+			}
+			summaries = append(summaries, s)
+		}
+
+		return nil
+	})
+
+	return
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStat(t *testing.T) {
+	a := assert.New(t)
+
+	t0 := time.Date(2016, time.June, 1, 12, 0, 0, 0, time.Local)
+	t1, t2 := t0.Add(5*time.Minute), t0.Add(10*time.Minute)
+
+	tests := []struct {
+		desc string
+		obs  [][3]float64 // Mean, low, high
+		exp  Stat
+	}{
+		{"None", nil, Stat{}},
+		{"Single", [][3]float64{{50, 48, 52}},
+			Stat{Min: 48, MinTime: t0, Max: 52, MaxTime: t0, Mean: 50, Samples: 1}},
+		{"Rising", [][3]float64{{50, 50, 50}, {60, 60, 60}, {70, 70, 70}},
+			Stat{Min: 50, MinTime: t0, Max: 70, MaxTime: t2, Mean: 60, Samples: 3}},
+		{"Ties keep the first", [][3]float64{{50, 40, 60}, {50, 40, 60}, {44, 42, 46}},
+			Stat{Min: 40, MinTime: t0, Max: 60, MaxTime: t0, Mean: 48, Samples: 3}},
+		{"Low and high differ from mean", [][3]float64{{50, 45, 55}, {52, 38, 54}, {51, 49, 61}},
+			Stat{Min: 38, MinTime: t1, Max: 61, MaxTime: t2, Mean: 51, Samples: 3}},
+	}
+
+	for _, test := range tests {
+		var s, first, rest Stat
+		for i, o := range test.obs {
+			ts := t0.Add(time.Duration(i) * 5 * time.Minute)
+			s.add(ts, o[0], o[1], o[2])
+			if i < 1 {
+				first.add(ts, o[0], o[1], o[2])
+			} else {
+				rest.add(ts, o[0], o[1], o[2])
+			}
+		}
+		a.Equal(test.exp, s, test.desc)
+
+		// Merging the stats of parts of the period gives the same result.
+		first.merge(rest)
+		a.InDelta(test.exp.Mean, first.Mean, 1e-9, test.desc+" merged mean")
+		first.Mean = test.exp.Mean
+		a.Equal(test.exp, first, test.desc+" merged")
+	}
+}
+
+// testRecord returns an archive record with the wind and outside
+// temperature set.
+func testRecord(ts time.Time, temp float64, speed int, dir int) (rec Record) {
+	rec.Timestamp = ts
+	rec.Bar = 30.0
+	rec.OutTemp, rec.OutTempLow, rec.OutTempHi = temp, temp-1, temp+1
+	rec.RainAccum = 0.01
+	rec.WindSpeedAvg, rec.WindSpeedHi = speed, speed+5
+	rec.WindDirPrevail, rec.WindDirHi = dir, dir
+	rec.WindSamples = 100
+
+	return
+}
+
+// testSummaries returns all of the period summaries in the database.
+func testSummaries(t *testing.T, r Records) map[Period][]Summary {
+	ss := map[Period][]Summary{}
+	for _, p := range Periods {
+		s, err := r.Summaries(p, time.Time{}, time.Now().AddDate(100, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss[p] = s
+	}
+
+	return ss
+}
+
+// equalSummaries asserts the summaries are equal, allowing for rounding
+// of the means since rollups merge them rather than adding each record.
+func equalSummaries(a *assert.Assertions, exp, got map[Period][]Summary, desc string) {
+	means := func(s *Summary) []*float64 {
+		return []*float64{&s.Bar.Mean, &s.InHumidity.Mean, &s.InTemp.Mean, &s.OutHumidity.Mean,
+			&s.OutTemp.Mean, &s.SolarRad.Mean, &s.UVIndex.Mean, &s.WindSpeed.Mean}
+	}
+
+	for _, p := range Periods {
+		if !a.Len(got[p], len(exp[p]), desc+" "+string(p)) {
+			continue
+		}
+		for i := range exp[p] {
+			e, g := exp[p][i], got[p][i]
+			em, gm := means(&e), means(&g)
+			for j := range em {
+				a.InDelta(*em[j], *gm[j], 1e-9, desc+" "+string(p)+" mean")
+				*gm[j] = *em[j]
+			}
+			a.InDelta(e.WindRun, g.WindRun, 1e-9, desc+" "+string(p)+" wind run")
+			g.WindRun = e.WindRun
+			a.Equal(e, g, desc+" "+string(p))
+		}
+	}
+}
+
+func TestSummaries(t *testing.T) {
+	a := assert.New(t)
+
+	t0 := time.Date(2016, time.June, 30, 23, 50, 0, 0, time.Local)
+	at := func(m int) time.Time { return t0.Add(time.Duration(m) * time.Minute) }
+
+	// Records spanning two days, months, and, for rollups, the middle of
+	// the year.
+	final := []Record{
+		testRecord(at(0), 60, 12, 0),
+		testRecord(at(5), 61, 12, 90),
+		testRecord(at(10), 62, 24, 90),
+		testRecord(at(15), 63, 0, 180),
+		testRecord(at(20), 64, 12, 90),
+	}
+
+	tests := []struct {
+		desc string
+		adds []Record
+	}{
+		{"In order", final},
+		{"Out of order within a day", []Record{final[0], final[2], final[1], final[3], final[4]}},
+		{"Out of order across days", []Record{final[0], final[1], final[3], final[4], final[2]}},
+		{"Reverse order", []Record{final[4], final[3], final[2], final[1], final[0]}},
+		{"Replaced", []Record{final[0], final[1], testRecord(at(10), 90, 50, 270), final[3], final[4], final[2]}},
+		{"Replaced last", []Record{final[0], final[1], final[2], final[3], testRecord(at(20), 10, 1, 0), final[4]}},
+		{"Corrected by QC", func() []Record {
+			bad := final[1]
+			bad.Flags = map[string]string{"outsideTemperature": "range"}
+			return []Record{final[0], bad, final[2], final[3], final[4], final[1]}
+		}()},
+	}
+
+	// The expected summaries are rebuilt from the final records in order.
+	exp := testRecords(t, t0, 0)
+	for _, rec := range final {
+		if err := exp.Add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := exp.db.Update(rebuildSummaries); err != nil {
+		t.Fatal(err)
+	}
+	expSummaries := testSummaries(t, exp)
+
+	// Rollup math
+	days := expSummaries[Day]
+	a.Len(days, 2)
+	a.Equal(3, days[0].Records)
+	a.True(at(20).Equal(days[0].Last))
+	a.InDelta(3.0, days[0].WindRun, 1e-9, "Calm interval adds no wind run")
+	a.InDelta(0.03, days[0].RainAccum, 1e-9)
+	a.InDelta(63.0, days[0].OutTemp.Mean, 1e-9)
+	a.Equal(61.0, days[0].OutTemp.Min)
+	a.Equal(65.0, days[0].OutTemp.Max)
+	a.True(at(20).Equal(days[0].OutTemp.MaxTime))
+	a.Equal(29.0, days[0].WindSpeed.Max)
+	a.Equal(90, days[0].WindDirHi)
+	a.Equal(90, days[0].WindDirPrevail)
+	a.Equal(2, days[1].Records)
+	a.InDelta(2.0, days[1].WindRun, 1e-9, "First interval uses the default")
+
+	months := expSummaries[Month]
+	a.Len(months, 2)
+	a.Equal(time.July, months[0].Begin.Month())
+	a.Equal(time.June, months[1].Begin.Month())
+
+	years := expSummaries[Year]
+	a.Len(years, 1)
+	a.Equal(5, years[0].Records)
+	a.InDelta(5.0, years[0].WindRun, 1e-9)
+	a.InDelta(62.0, years[0].OutTemp.Mean, 1e-9)
+	a.Equal(59.0, years[0].OutTemp.Min)
+	a.Equal(65.0, years[0].OutTemp.Max)
+
+	// Range queries
+	ss, err := exp.Summaries(Day, at(10), at(20))
+	a.Nil(err)
+	a.Len(ss, 1)
+	ss, err = exp.Summaries(Month, at(0), at(20))
+	a.Nil(err)
+	a.Len(ss, 2)
+	ss, err = exp.Summaries(Day, at(-24*60), at(-24*60))
+	a.Nil(err)
+	a.Empty(ss)
+	_, err = exp.Summaries(Period("week"), at(0), at(20))
+	a.Equal(ErrPeriod, err)
+
+	for _, test := range tests {
+		r := testRecords(t, t0, 0)
+		for _, rec := range test.adds {
+			if err := r.Add(rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		equalSummaries(a, expSummaries, testSummaries(t, r), test.desc)
+	}
+}
@@ -6,12 +6,32 @@
 // unsubscribe, and publish operations.
 package events
 
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	queueLen = 32 // Events queued per subscriber, about a minute of loops
+	maxDrops = 8  // Consecutive drops with a full queue before eviction
+)
+
 // Broker is an event broker instance.
 type Broker struct {
-	events chan Event            // New events that will be broacast to all subscribers
-	subs   map[chan Event]string // Subscriber map as [channel] = address:port
-	sub    chan sub              // Subscribe requests pending add to map
-	unsub  chan sub              // Unsubscribe requests pending removal from map
+	events chan Event          // New events that will be broacast to all subscribers
+	subs   map[chan Event]*sub // Subscriber map as [channel] = subscriber
+	sub    chan *sub           // Subscribe requests pending add to map
+	unsub  chan *sub           // Unsubscribe requests pending removal from map
+	list   chan chan Stats     // Subscriber listing requests
+
+	dropped uint64 // Events dropped for all subscribers
+	evicted uint64 // Subscribers evicted for falling behind
+
+	ctx    context.Context // Broker lifetime
+	cancel context.CancelFunc
 }
 
 // Event represents an event that occurred.
@@ -20,37 +40,135 @@ type Event struct {
 	Data interface{} // weatherlink.Archive, loop, ...
 }
 
+// Subscriber is the state of a subscriber.
+type Subscriber struct {
+	Name      string    `json:"name"`
+	Topics    []string  `json:"topics,omitempty"`
+	Since     time.Time `json:"since"`
+	Queued    int       `json:"queued"`
+	Delivered uint64    `json:"delivered"`
+	Dropped   uint64    `json:"dropped"`
+}
+
+// Stats is the state of the broker and its subscribers.
+type Stats struct {
+	Subscribers []Subscriber `json:"subscribers"`
+	Dropped     uint64       `json:"dropped"` // Events dropped, including by subscribers that are gone
+	Evicted     uint64       `json:"evicted"`
+}
+
 type sub struct {
-	name   string     // Subscriber name in the form address:port
+	Subscriber
 	events chan Event // Subscriber event channel
+	behind int        // Consecutive events dropped
+}
+
+// wants returns true if the subscriber is interested in the event.
+func (s sub) wants(e Event) bool {
+	return Match(s.Topics, e.Name)
+}
+
+// send queues an event for the subscriber without blocking.  If the queue
+// is full the event is dropped and false is returned once the subscriber
+// has fallen too far behind.
+func (s *sub) send(e Event) bool {
+	select {
+	case s.events <- e:
+		s.Delivered++
+		s.behind = 0
+	default:
+		s.Dropped++
+		s.behind++
+	}
+
+	return s.behind < maxDrops
+}
+
+// Match returns true if an event name matches any of the topics.  An empty
+// list of topics matches all events.
+func Match(topics []string, name string) bool {
+	if len(topics) < 1 {
+		return true
+	}
+
+	for _, t := range topics {
+		if ok, _ := path.Match(t, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Topics splits a comma separated list of event name patterns, such as
+// "loop,archive" or "*", into a slice suitable for Subscribe.  Empty
+// patterns are ignored and malformed patterns return path.ErrBadPattern.
+func Topics(s string) (topics []string, err error) {
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if _, err = path.Match(t, ""); err != nil {
+			return nil, err
+		}
+		topics = append(topics, t)
+	}
+
+	return
 }
 
 // New creates a new event broker instance and launches the server
 // that handles all incoming events and subscription requests.
 func New() *Broker {
+	return NewContext(context.Background())
+}
+
+// NewContext creates a new event broker instance like New that is closed
+// when the context is done.
+func NewContext(ctx context.Context) *Broker {
 	b := &Broker{
 		events: make(chan Event, 8),
-		subs:   make(map[chan Event]string),
-		sub:    make(chan sub),
-		unsub:  make(chan sub),
+		subs:   make(map[chan Event]*sub),
+		sub:    make(chan *sub),
+		unsub:  make(chan *sub),
+		list:   make(chan chan Stats),
 	}
+	b.ctx, b.cancel = context.WithCancel(ctx)
 
 	go func() {
 		for {
 			select {
+			case <-b.ctx.Done(): // Closed
+				for c := range b.subs {
+					delete(b.subs, c)
+					close(c)
+				}
+				return
 			case c := <-b.sub: // Subscribe requests
-				b.subs[c.events] = c.name
+				b.subs[c.events] = c
 			case c := <-b.unsub: // Unsubscribe requests
 				delete(b.subs, c.events)
-			case e := <-b.events: // Published events
-				for c := range b.subs {
+			case c := <-b.list: // Subscriber listing requests
+				// Broadcast pending events first so the listing reflects
+				// everything that's been published.
+				for pending := true; pending; {
 					select {
-					case c <- e:
+					case e := <-b.events:
+						b.broadcast(e)
 					default:
-						// If a subscribers io.Writer can't flush for
-						// approximately 15 minutes will begin to block.
+						pending = false
 					}
 				}
+
+				ss := make([]Subscriber, 0, len(b.subs))
+				for _, s := range b.subs {
+					s.Queued = len(s.events)
+					ss = append(ss, s.Subscriber)
+				}
+				sort.Slice(ss, func(i, j int) bool { return ss[i].Since.Before(ss[j].Since) })
+				c <- Stats{Subscribers: ss, Dropped: b.dropped, Evicted: b.evicted}
+			case e := <-b.events: // Published events
+				b.broadcast(e)
 			}
 		}
 	}()
@@ -58,19 +176,86 @@ func New() *Broker {
 	return b
 }
 
-// Subscribe registers a client to receive events.
-func (b Broker) Subscribe(name string) chan Event {
-	c := make(chan Event)
-	b.sub <- sub{name: name, events: c}
+// broadcast sends an event to all interested subscribers.
+func (b *Broker) broadcast(e Event) {
+	for c, s := range b.subs {
+		if !s.wants(e) {
+			continue
+		}
+		ok := s.send(e)
+		if s.behind > 0 {
+			b.dropped++
+		}
+		if !ok {
+			// Evict subscribers that have fallen too far behind by
+			// closing their channel so they know to go away.
+			delete(b.subs, c)
+			close(c)
+			b.evicted++
+		}
+	}
+}
+
+// Subscribe registers a client to receive events.  If topics are specified
+// only events with a matching name are delivered.  Topics may contain
+// wildcards using path.Match syntax, e.g. "*" or "arch*".
+//
+// Events are queued for each subscriber and if it falls too far behind, or
+// the broker is closed, the channel is closed.
+func (b *Broker) Subscribe(name string, topics ...string) chan Event {
+	c := make(chan Event, queueLen)
+	select {
+	case b.sub <- &sub{
+		Subscriber: Subscriber{Name: name, Topics: topics, Since: time.Now()},
+		events:     c,
+	}:
+	case <-b.ctx.Done():
+		close(c)
+	}
 	return c
 }
 
 // Unsubscribe removes a client that was previously receiving events.
-func (b Broker) Unsubscribe(c chan Event) {
-	b.unsub <- sub{events: c}
+func (b *Broker) Unsubscribe(c chan Event) {
+	select {
+	case b.unsub <- &sub{events: c}:
+	case <-b.ctx.Done():
+	}
+}
+
+// Subscribers returns the state of all subscribers in the order they
+// subscribed.
+func (b *Broker) Subscribers() []Subscriber {
+	return b.Stats().Subscribers
+}
+
+// Stats returns the state of the broker and all subscribers.
+func (b *Broker) Stats() (s Stats) {
+	c := make(chan Stats)
+	select {
+	case b.list <- c:
+		s = <-c
+	case <-b.ctx.Done():
+	}
+
+	return
+}
+
+// Publish sends a new event to subscribers.  Once the broker is closed
+// events are discarded.
+func (b *Broker) Publish(e Event) {
+	select {
+	case b.events <- e:
+	case <-b.ctx.Done():
+	}
+}
+
+// Close stops the broker and closes all subscriber channels.
+func (b *Broker) Close() {
+	b.cancel()
 }
 
-// Publish sends a new event to subscribers.
-func (b Broker) Publish(e Event) {
-	b.events <- e
+// Done returns a channel that's closed when the broker is closed.
+func (b *Broker) Done() <-chan struct{} {
+	return b.ctx.Done()
 }
@@ -0,0 +1,162 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package events
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopics(t *testing.T) {
+	a := assert.New(t)
+
+	topics, err := Topics("")
+	a.Nil(err)
+	a.Empty(topics)
+
+	topics, err = Topics("loop, archive,,")
+	a.Nil(err)
+	a.Equal([]string{"loop", "archive"}, topics)
+
+	_, err = Topics("loop,[")
+	a.Equal(path.ErrBadPattern, err)
+}
+
+func TestWants(t *testing.T) {
+	a := assert.New(t)
+
+	all := sub{}
+	a.True(all.wants(Event{Name: "loop"}))
+	a.True(all.wants(Event{Name: "archive"}))
+
+	loop := sub{Subscriber: Subscriber{Topics: []string{"loop"}}}
+	a.True(loop.wants(Event{Name: "loop"}))
+	a.False(loop.wants(Event{Name: "archive"}))
+
+	wild := sub{Subscriber: Subscriber{Topics: []string{"speci", "arch*"}}}
+	a.True(wild.wants(Event{Name: "archive"}))
+	a.True(wild.wants(Event{Name: "speci"}))
+	a.False(wild.wants(Event{Name: "loop"}))
+}
+
+func TestEviction(t *testing.T) {
+	a := assert.New(t)
+
+	b := New()
+	slow := b.Subscribe("slow", "loop")
+	other := b.Subscribe("other", "archive")
+
+	// Fill the queue and then keep publishing until the subscriber is
+	// evicted.
+	for i := 0; i < queueLen+maxDrops; i++ {
+		b.Publish(Event{Name: "loop", Data: i})
+	}
+
+	ss := b.Subscribers()
+	a.Len(ss, 1)
+	a.Equal("other", ss[0].Name)
+	a.Equal(uint64(0), ss[0].Delivered)
+
+	// The queued events are still delivered before the channel is closed.
+	var n int
+	for e := range slow {
+		a.Equal(n, e.Data)
+		n++
+	}
+	a.Equal(queueLen, n)
+
+	b.Unsubscribe(other)
+	a.Empty(b.Subscribers())
+
+	st := b.Stats()
+	a.Equal(uint64(maxDrops), st.Dropped)
+	a.Equal(uint64(1), st.Evicted)
+}
+
+func TestDropped(t *testing.T) {
+	a := assert.New(t)
+
+	b := New()
+	c := b.Subscribe("behind")
+	for i := 0; i < queueLen+maxDrops-1; i++ {
+		b.Publish(Event{Name: "loop"})
+	}
+
+	ss := b.Subscribers()
+	a.Len(ss, 1)
+	a.Equal(queueLen, ss[0].Queued)
+	a.Equal(uint64(queueLen), ss[0].Delivered)
+	a.Equal(uint64(maxDrops-1), ss[0].Dropped)
+
+	// Catching up resets the eviction count but not the drop counter.
+	<-c
+	b.Publish(Event{Name: "loop"})
+	b.Publish(Event{Name: "loop"})
+	ss = b.Subscribers()
+	a.Len(ss, 1)
+	a.Equal(uint64(maxDrops), ss[0].Dropped)
+}
+
+func TestStatsWhilePublishing(t *testing.T) {
+	a := assert.New(t)
+
+	b := New()
+	defer b.Close()
+	b.Subscribe("stalled")
+
+	// Stats must be safe to call while events are being broadcast and
+	// counters updated, e.g. by a metrics scrape.
+	const n = queueLen + maxDrops
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			b.Publish(Event{Name: "loop"})
+		}
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			b.Stats()
+		}
+	}
+
+	st := b.Stats()
+	a.Empty(st.Subscribers)
+	a.Equal(uint64(maxDrops), st.Dropped)
+	a.Equal(uint64(1), st.Evicted)
+}
+
+func TestClose(t *testing.T) {
+	a := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := NewContext(ctx)
+	c := b.Subscribe("closed")
+	b.Publish(Event{Name: "loop"})
+	a.Equal(1, b.Subscribers()[0].Queued)
+	cancel()
+
+	// Queued events are still delivered before the channel is closed.
+	var n int
+	for range c {
+		n++
+	}
+	a.Equal(1, n)
+
+	// Nothing blocks once the broker is closed.
+	<-b.Done()
+	b.Publish(Event{Name: "loop"})
+	_, ok := <-b.Subscribe("late")
+	a.False(ok)
+	a.Nil(b.Subscribers())
+	b.Unsubscribe(c)
+	b.Close()
+}
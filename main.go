@@ -11,6 +11,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 )
 
 var banner = fmt.Sprintf("Davis Instruments weather station (version %s)", version)
@@ -19,7 +20,9 @@ type config struct {
 	addr  string
 	dev   string
 	db    string
+	qc    string
 	res   string
+	stn   stationInfo
 	debug bool
 	trace bool
 }
@@ -29,6 +32,13 @@ func main() {
 	flag.StringVar(&cfg.addr, "addr", "", "server bind address")
 	flag.StringVar(&cfg.dev, "dev", "", "weather station device (REQUIRED)")
 	flag.StringVar(&cfg.db, "db", "weather.db", "bolt database file")
+	flag.Float64Var(&cfg.stn.Loc.Elev, "elev", 0, "station elevation in feet")
+	flag.StringVar(&cfg.stn.ID, "id", "", "station identifier, like an ICAO code")
+	flag.Float64Var(&cfg.stn.Loc.Lat, "lat", 0, "station latitude in decimal degrees")
+	flag.Float64Var(&cfg.stn.Loc.Lon, "lon", 0, "station longitude in decimal degrees (west is negative)")
+	flag.StringVar(&cfg.stn.Name, "name", "", "station name")
+	flag.StringVar(&cfg.stn.WMO, "wmo", "", "WMO block and station number")
+	flag.StringVar(&cfg.qc, "qc", "", "quality control limits file")
 	flag.StringVar(&cfg.res, "res", ".", "resources path")
 	flag.BoolVar(&cfg.debug, "debug", false, "enable debug mode")
 	flag.BoolVar(&cfg.trace, "trace", false, "enable trace mode")
@@ -46,6 +56,7 @@ func main() {
 		flag.Usage()
 		return
 	}
+	cfg.stn.ID = strings.ToUpper(cfg.stn.ID)
 
 	Info.Println(banner)
 	server(cfg)
@@ -7,17 +7,272 @@ package main
 import (
 	"fmt"
 	"math"
+	"sort"
 	"time"
 
+	"github.com/ebarkie/davis-station/internal/archive"
 	"github.com/ebarkie/weatherlink/packet"
 	"github.com/ebarkie/weatherlink/units"
 )
 
-// metar generates a report string for a given Loop struct.
-func metar(l loop) string {
+const (
+	windVariabilityPeriod = 2 * time.Minute  // Period wind direction variability is evaluated over
+	synopticWindow        = 10 * time.Minute // Reports this long before a synoptic hour are for it
+)
+
+// windVariability returns the range of wind directions over the 2 minutes
+// ending with the loop packet.  The range is clockwise from the from
+// direction to the to direction and arc is how many degrees it covers.
+// Calm samples don't have a direction so they're skipped.  The loop history
+// is in descending order.
+func windVariability(l loop, ls []loop) (from, to, arc int) {
+	var dirs []int
+	for _, h := range append([]loop{l}, ls...) {
+		if h.Timestamp.After(l.Timestamp) || l.Timestamp.Sub(h.Timestamp) > windVariabilityPeriod {
+			continue
+		}
+		if h.Wind.Cur.Speed > 0 {
+			dirs = append(dirs, h.Wind.Cur.Dir%360)
+		}
+	}
+	if len(dirs) < 2 {
+		return
+	}
+	sort.Ints(dirs)
+
+	// The smallest arc containing all of the directions is everything
+	// except the largest gap between them.
+	gap, after := 0, 0
+	for i := range dirs {
+		g := dirs[(i+1)%len(dirs)] - dirs[i]
+		if i == len(dirs)-1 {
+			g += 360
+		}
+		if g > gap {
+			gap, after = g, i
+		}
+	}
+
+	return dirs[(after+1)%len(dirs)], dirs[after], 360 - gap
+}
+
+// synopticHour returns the top of the hour in loc that a report at time t
+// is for.  Routine reports are observed in the last minutes before the hour
+// so if t isn't within the synoptic window of it then ok is false.
+func synopticHour(t time.Time, loc *time.Location) (h time.Time, ok bool) {
+	t = t.In(loc)
+	h = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+	if h.Before(t) {
+		h = h.Add(time.Hour)
+	}
+
+	return h, h.Sub(t) < synopticWindow
+}
+
+// metarHistory returns how much archive history a report at time t needs.
+// Every report needs the last hour for the peak wind and the synoptic hours
+// also summarize the last 3, 6, or 24 hours.
+func metarHistory(t time.Time) time.Duration {
+	if h, ok := synopticHour(t, time.Local); ok && h.Hour() == 0 {
+		return 24 * time.Hour
+	}
+	if h, ok := synopticHour(t, time.UTC); ok && h.Hour()%6 == 0 {
+		return 6 * time.Hour
+	} else if ok && h.Hour()%3 == 0 {
+		return 3 * time.Hour
+	}
+
+	return time.Hour
+}
+
+// archiveWithin returns the archive records that cover the period d ending
+// at time t.  Records are stamped at the end of the interval they cover and
+// are in descending order.
+func archiveWithin(as []archive.Record, t time.Time, d time.Duration) (within []archive.Record) {
+	for _, rec := range as {
+		if rec.Timestamp.After(t) {
+			continue
+		}
+		if !rec.Timestamp.After(t.Add(-d)) {
+			break
+		}
+		within = append(within, rec)
+	}
+
+	return
+}
+
+// archiveAt returns the most recent archive record at or before time t.  If
+// there isn't one within 15 minutes then ok is false.
+func archiveAt(as []archive.Record, t time.Time) (rec archive.Record, ok bool) {
+	for _, rec = range as {
+		if !rec.Timestamp.After(t) {
+			return rec, t.Sub(rec.Timestamp) <= 15*time.Minute
+		}
+	}
+
+	return
+}
+
+// pressureTendency returns the WMO code 0200 characteristic of the pressure
+// tendency given the change in the first and second halves of the 3 hour
+// period.
+func pressureTendency(d1, d2 float64) int {
+	const steady = 0.05 // hPa
+
+	rising := func(d float64) bool { return d >= steady }
+	falling := func(d float64) bool { return d <= -steady }
+
+	switch net := d1 + d2; {
+	case net >= steady:
+		switch {
+		case falling(d2):
+			return 0 // Increasing, then decreasing
+		case !rising(d1):
+			return 3 // Decreasing or steady, then increasing
+		case !rising(d2):
+			return 1 // Increasing, then steady
+		default:
+			return 2 // Increasing
+		}
+	case net <= -steady:
+		switch {
+		case rising(d2):
+			return 5 // Decreasing, then increasing
+		case !falling(d1):
+			return 8 // Steady or increasing, then decreasing
+		case !falling(d2):
+			return 6 // Decreasing, then steady
+		default:
+			return 7 // Decreasing
+		}
+	default:
+		switch {
+		case rising(d1) && falling(d2):
+			return 0 // Increasing, then decreasing
+		case falling(d1) && rising(d2):
+			return 5 // Decreasing, then increasing
+		default:
+			return 4 // Steady
+		}
+	}
+}
+
+// tendencyGroup returns the characteristic and amount of the pressure
+// tendency over the 3 hours ending at time t, in tenths of a hectopascal,
+// using the archive records and the current pressure.  If there isn't a
+// record from 3 hours before then ok is false.
+func tendencyGroup(l loop, t time.Time, as []archive.Record) (appp string, ok bool) {
+	begin, ok := archiveAt(as, t.Add(-3*time.Hour))
+	if !ok {
+		return
+	}
+
+	p0 := units.Pressure(begin.Bar * units.Inches).Millibars()
+	p3 := units.Pressure(l.Bar.SeaLevel * units.Inches).Millibars()
+	p1 := (p0 + p3) / 2
+	if mid, ok := archiveAt(as, t.Add(-90*time.Minute)); ok {
+		p1 = units.Pressure(mid.Bar * units.Inches).Millibars()
+	}
+
+	return fmt.Sprintf("%d%03.f", pressureTendency(p1-p0, p3-p1), math.Abs(p3-p0)*10), true
+}
+
+// tempExtremes returns the maximum and minimum temperatures over the period
+// d ending at time t using the archive records.  Records that failed quality
+// control are skipped.  If there aren't any records then ok is false.
+func tempExtremes(as []archive.Record, t time.Time, d time.Duration) (max, min float64, ok bool) {
+	for _, rec := range archiveWithin(as, t, d) {
+		_, badHi := rec.Flags["outsideTemperatureHigh"]
+		_, badLow := rec.Flags["outsideTemperatureLow"]
+		if badHi || badLow {
+			continue
+		}
+		if !ok || rec.OutTempHi > max {
+			max = rec.OutTempHi
+		}
+		if !ok || rec.OutTempLow < min {
+			min = rec.OutTempLow
+		}
+		ok = true
+	}
+
+	return
+}
+
+// tempGroup formats a Fahrenheit temperature as a sign and tenths of a
+// degree Celsius.
+func tempGroup(f float64) string {
+	t := units.Fahrenheit(f).Celsius()
+	if t < 0.0 {
+		return fmt.Sprintf("1%03.f", t*-10)
+	}
+
+	return fmt.Sprintf("0%03.f", t*10)
+}
+
+// report generates a METAR report for a loop packet using the server's loop
+// history and archive records.
+func (sc serverCtx) report(l loop) string {
+	as := sc.ar.Get(l.Timestamp.Add(-metarHistory(l.Timestamp)-synopticWindow), l.Timestamp)
+
+	return metar(sc.stn.ID, l, sc.lb.loops(), as)
+}
+
+// dewPoint returns the dew point in Fahrenheit for a temperature in
+// Fahrenheit and relative humidity using the Magnus formula.
+func dewPoint(f float64, rh int) float64 {
+	const b, c = 17.62, 243.12
+
+	if rh < 1 {
+		rh = 1
+	}
+	t := units.Fahrenheit(f).Celsius()
+	g := math.Log(float64(rh)/100) + b*t/(c+t)
+
+	return c*g/(b-g)*9/5 + 32
+}
+
+// archiveLoop reconstructs a loop packet from an archive record so a
+// METAR can be generated for it.  The archive records, in descending order,
+// are used for the hourly and 24 hour rain accumulations.
+func archiveLoop(rec archive.Record, as []archive.Record) (l loop) {
+	l.Timestamp = rec.Timestamp
+	l.Bar.Altimeter = rec.Bar
+	l.Bar.SeaLevel = rec.Bar
+	l.OutTemp = rec.OutTemp
+	l.OutHumidity = rec.OutHumidity
+	l.DewPoint = dewPoint(rec.OutTemp, rec.OutHumidity)
+	l.Rain.Rate = rec.RainRateHi
+	for _, r := range archiveWithin(as, rec.Timestamp, 24*time.Hour) {
+		if r.Timestamp.After(rec.Timestamp.Add(-time.Hour)) {
+			l.Rain.Accum.LastHour += r.RainAccum
+		}
+		l.Rain.Accum.Last24Hours += r.RainAccum
+	}
+	l.Wind.Cur.Dir = rec.WindDirPrevail
+	l.Wind.Cur.Speed = rec.WindSpeedAvg
+	l.Wind.Gust.Last10MinDir = rec.WindDirHi
+	l.Wind.Gust.Last10MinSpeed = float64(rec.WindSpeedHi)
+
+	return
+}
+
+// metar generates a report string for a given Loop struct.  The station
+// identifier is omitted if it's not configured.  The loop
+// history is used for the variable wind direction and the archive records
+// are used for the remarks that summarize the last hour and the 3, 6, and
+// 24 hour periods ending at the synoptic hours.  The synoptic remarks are
+// only included in reports for those hours.  Both are in descending order.
+func metar(id string, l loop, ls []loop, as []archive.Record) string {
 	// Type
 	s := "METAR"
 
+	// Station Identifier
+	if id != "" {
+		s += " " + id
+	}
+
 	// Date/Time
 	s += fmt.Sprintf(" %sZ", l.Timestamp.In(time.UTC).Format("021504"))
 
@@ -25,11 +280,24 @@ func metar(l loop) string {
 	s += " AUTO" // Indicates a fully automated report with no human intervention
 
 	// Wind
-	s += fmt.Sprintf(" %03d%02.f", l.Wind.Cur.Dir, units.Speed(float64(l.Wind.Cur.Speed)*units.MPH).Knots())
+	//
+	// If the direction varies by 60 degrees or more it's reported as
+	// variable (VRB) for light winds and with a variable direction group
+	// for winds above 6 knots.
+	speed := units.Speed(float64(l.Wind.Cur.Speed) * units.MPH).Knots()
+	from, to, arc := windVariability(l, ls)
+	if arc >= 60 && math.Round(speed) > 0 && math.Round(speed) <= 6 {
+		s += fmt.Sprintf(" VRB%02.f", speed)
+	} else {
+		s += fmt.Sprintf(" %03d%02.f", l.Wind.Cur.Dir, speed)
+	}
 	if units.Speed(l.Wind.Gust.Last10MinSpeed*units.MPH).Knots() >= 0.50 {
 		s += fmt.Sprintf("G%02.f", units.Speed(l.Wind.Gust.Last10MinSpeed*units.MPH).Knots())
 	}
 	s += "KT"
+	if arc >= 60 && math.Round(speed) > 6 {
+		s += fmt.Sprintf(" %03dV%03d", from, to)
+	}
 
 	// Weather Phenomena
 	if l.Rain.Rate >= 1.0 { // Heavy
@@ -58,6 +326,40 @@ func metar(l loop) string {
 	// Remarks
 	s += " RMK AO1" // Automated station without a precipitation descriminator
 
+	// Peak Wind over the last hour if it exceeds 25 knots
+	var pk struct {
+		speed float64
+		dir   int
+		t     time.Time
+	}
+	for _, rec := range archiveWithin(as, l.Timestamp, time.Hour) {
+		if _, bad := rec.Flags["windSpeedHigh"]; bad {
+			continue
+		}
+		if kt := units.Speed(float64(rec.WindSpeedHi) * units.MPH).Knots(); kt > pk.speed {
+			pk.speed, pk.dir, pk.t = kt, rec.WindDirHi, rec.Timestamp
+		}
+	}
+	for _, h := range ls {
+		if h.Timestamp.After(l.Timestamp) || l.Timestamp.Sub(h.Timestamp) > time.Hour {
+			continue
+		}
+		if _, bad := h.Flags["wind.current.speed"]; bad {
+			continue
+		}
+		if kt := units.Speed(float64(h.Wind.Cur.Speed) * units.MPH).Knots(); kt > pk.speed {
+			pk.speed, pk.dir, pk.t = kt, h.Wind.Cur.Dir, h.Timestamp
+		}
+	}
+	if math.Round(pk.speed) > 25 {
+		s += fmt.Sprintf(" PK WND %03d%02.f/", pk.dir, pk.speed)
+		if pk.t.In(time.UTC).Hour() == l.Timestamp.In(time.UTC).Hour() {
+			s += pk.t.In(time.UTC).Format("04")
+		} else {
+			s += pk.t.In(time.UTC).Format("1504")
+		}
+	}
+
 	// Pressure Rising or Falling Rapidly
 	if l.Bar.Trend == packet.RisingRapid {
 		s += " PRESRR"
@@ -74,6 +376,26 @@ func metar(l loop) string {
 		s += fmt.Sprintf(" P%04.f", l.Rain.Accum.LastHour*100)
 	}
 
+	// 3- and 6-Hour Precipitation Amount
+	syn, ok := synopticHour(l.Timestamp, time.UTC)
+	six := ok && syn.Hour()%6 == 0
+	three := ok && syn.Hour()%3 == 0
+	if three {
+		d := 3 * time.Hour
+		if six {
+			d = 6 * time.Hour
+		}
+		var accum float64
+		for _, rec := range archiveWithin(as, syn, d) {
+			if _, bad := rec.Flags["rainAccumulation"]; !bad {
+				accum += rec.RainAccum
+			}
+		}
+		if accum > 0.0 {
+			s += fmt.Sprintf(" 6%04.f", accum*100)
+		}
+	}
+
 	// 24-Hour Precipitation Amount
 	if l.Rain.Accum.Last24Hours > 0.0 {
 		s += fmt.Sprintf(" 7%04.f", l.Rain.Accum.Last24Hours*100)
@@ -91,5 +413,26 @@ func metar(l loop) string {
 		s += fmt.Sprintf("0%03.f", t*10)
 	}
 
+	// 6-Hourly Maximum and Minimum Temperature
+	if six {
+		if max, min, ok := tempExtremes(as, syn, 6*time.Hour); ok {
+			s += " 1" + tempGroup(max) + " 2" + tempGroup(min)
+		}
+	}
+
+	// 24-Hour Maximum and Minimum Temperature at local midnight
+	if mid, ok := synopticHour(l.Timestamp, time.Local); ok && mid.Hour() == 0 {
+		if max, min, ok := tempExtremes(as, mid, 24*time.Hour); ok {
+			s += " 4" + tempGroup(max) + tempGroup(min)
+		}
+	}
+
+	// 3-Hourly Pressure Tendency
+	if three {
+		if appp, ok := tendencyGroup(l, syn, as); ok {
+			s += " 5" + appp
+		}
+	}
+
 	return s
 }
@@ -7,12 +7,132 @@ package main
 import (
 	"fmt"
 	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
 )
 
 func Example_metar() {
 	l := loop{Timestamp: time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)}
-	fmt.Println(metar(l))
+	fmt.Println(metar("", l, nil, nil))
 
 	// Output:
 	// METAR 021504Z AUTO 00000KT M18/M18 A0000 RMK AO1 SLP000 T11781178
 }
+
+func Example_metarVariableWind() {
+	l := loop{Timestamp: time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)}
+	l.Wind.Cur.Dir = 10
+	l.Wind.Cur.Speed = 12
+
+	// Directions from 320 through north to 30 degrees in the last 2
+	// minutes and an old sample that's ignored.
+	var ls []loop
+	for i, dir := range []int{10, 30, 350, 320, 180} {
+		h := l
+		h.Timestamp = l.Timestamp.Add(-time.Duration(i) * 40 * time.Second)
+		h.Wind.Cur.Dir = dir
+		ls = append(ls, h)
+	}
+	fmt.Println(metar("", l, ls, nil))
+
+	// Light winds are variable
+	l.Wind.Cur.Speed = 5
+	for i := range ls {
+		ls[i].Wind.Cur.Speed = 5
+	}
+	fmt.Println(metar("", l, ls, nil))
+
+	// Output:
+	// METAR 021504Z AUTO 01010KT 320V030 M18/M18 A0000 RMK AO1 SLP000 T11781178
+	// METAR 021504Z AUTO VRB04KT M18/M18 A0000 RMK AO1 SLP000 T11781178
+}
+
+func Example_metarPeakWind() {
+	l := loop{Timestamp: time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)}
+
+	// A gust flagged by quality control isn't the peak wind.
+	var ls []loop
+	for i, speed := range []int{10, 90, 32} {
+		h := l
+		h.Timestamp = l.Timestamp.Add(-time.Duration(i) * 10 * time.Minute)
+		h.Wind.Cur.Dir = 90 * (i + 1)
+		h.Wind.Cur.Speed = speed
+		if speed > 50 {
+			h.Flags = map[string]string{"wind.current.speed": "step"}
+		}
+		ls = append(ls, h)
+	}
+	fmt.Println(metar("", l, ls, nil))
+
+	// Output:
+	// METAR 021504Z AUTO 00000KT M18/M18 A0000 RMK AO1 PK WND 27028/1444 SLP000 T11781178
+}
+
+func Example_metarRemarks() {
+	// The 24-hour group is reported at local midnight
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	time.Local = time.UTC
+
+	l := loop{Timestamp: time.Date(2006, time.January, 2, 18, 0, 0, 0, time.UTC)}
+	l.Bar.Altimeter = 29.92
+	l.Bar.SeaLevel = 29.92
+	l.OutTemp = 50.0
+	l.DewPoint = 41.0
+
+	// Hourly archive records with falling pressure, an afternoon peak wind,
+	// and some recent rain.
+	var as []archive.Record
+	for i := 0; i <= 24; i++ {
+		rec := archive.Record{}
+		rec.Timestamp = l.Timestamp.Add(-time.Duration(i) * time.Hour)
+		rec.Bar = 29.92 + float64(i)*0.01
+		rec.OutTempHi = 55.0 - float64(i)
+		rec.OutTempLow = 53.0 - float64(i)
+		if i < 3 {
+			rec.RainAccum = 0.02
+		}
+		if i == 0 {
+			rec.WindSpeedHi = 35
+			rec.WindDirHi = 270
+		}
+		as = append(as, rec)
+	}
+	fmt.Println(metar("", l, nil, as))
+
+	// Reports observed shortly before the hour are for it and the periods
+	// end at the synoptic hour.
+	obs := l
+	obs.Timestamp = l.Timestamp.Add(-5 * time.Minute)
+	fmt.Println(metar("", obs, nil, as))
+
+	// Other reports during a synoptic hour don't summarize the periods.
+	obs.Timestamp = l.Timestamp.Add(37 * time.Minute)
+	fmt.Println(metar("", obs, nil, as))
+
+	l.Timestamp = l.Timestamp.Add(6 * time.Hour)
+	fmt.Println(metar("", l, nil, as))
+
+	// Output:
+	// METAR 021800Z AUTO 00000KT 10/05 A2992 RMK AO1 PK WND 27030/00 SLP132 60006 T01000050 10128 20089 57010
+	// METAR 021755Z AUTO 00000KT 10/05 A2992 RMK AO1 SLP132 60006 T01000050 10128 20089 57010
+	// METAR 021837Z AUTO 00000KT 10/05 A2992 RMK AO1 PK WND 27030/00 SLP132 T01000050
+	// METAR 030000Z AUTO 00000KT 10/05 A2992 RMK AO1 SLP132 T01000050 401280022
+}
+
+func Example_metarArchive() {
+	rec := archive.Record{}
+	rec.Timestamp = time.Date(2006, time.January, 2, 14, 0, 0, 0, time.UTC)
+	rec.Bar = 30.12
+	rec.OutTemp = 68.0
+	rec.OutHumidity = 50
+	rec.WindDirPrevail = 225
+	rec.WindSpeedAvg = 9
+	rec.WindSpeedHi = 17
+	rec.RainAccum = 0.01
+	as := []archive.Record{rec}
+
+	fmt.Println(metar("KXYZ", archiveLoop(rec, as), nil, as))
+
+	// Output:
+	// METAR KXYZ 021400Z AUTO 22508G15KT 20/09 A3012 RMK AO1 SLP200 P0001 70001 T02000093
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// Prometheus metrics in the text exposition format.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// httpDurationBuckets are the upper bounds in seconds of the HTTP request
+// duration histogram buckets.
+var httpDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// httpRouteMetrics are the requests and their durations for one HTTP route.
+type httpRouteMetrics struct {
+	codes   map[int]uint64 // Requests by status code
+	buckets []uint64       // Cumulative duration histogram
+	sum     float64        // Seconds
+	count   uint64
+}
+
+// serverMetrics are the operational metrics that aren't tracked anywhere
+// else.
+type serverMetrics struct {
+	archiveAdded atomic.Int64
+
+	http map[string]*httpRouteMetrics
+	sync.Mutex
+}
+
+// newServerMetrics returns new empty server metrics.
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{http: map[string]*httpRouteMetrics{}}
+}
+
+// request records a completed HTTP request.
+func (m *serverMetrics) request(route string, code int, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	rm, ok := m.http[route]
+	if !ok {
+		rm = &httpRouteMetrics{
+			codes:   map[int]uint64{},
+			buckets: make([]uint64, len(httpDurationBuckets)),
+		}
+		m.http[route] = rm
+	}
+
+	rm.codes[code]++
+	for i, le := range httpDurationBuckets {
+		if d.Seconds() <= le {
+			rm.buckets[i]++
+		}
+	}
+	rm.sum += d.Seconds()
+	rm.count++
+}
+
+// promWriter writes metrics in the Prometheus text exposition format.
+type promWriter struct {
+	io.Writer
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// family writes the help and type of a metric family.
+func (p promWriter) family(name, typ, help string) {
+	fmt.Fprintf(p, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(p, "# TYPE %s %s\n", name, typ)
+}
+
+// sample writes a sample with optional label name and value pairs.
+func (p promWriter) sample(name string, v float64, labels ...string) {
+	var ls []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		ls = append(ls, fmt.Sprintf(`%s="%s"`, labels[i], promEscaper.Replace(labels[i+1])))
+	}
+	if len(ls) > 0 {
+		name += "{" + strings.Join(ls, ",") + "}"
+	}
+
+	var s string
+	switch {
+	case math.IsInf(v, 1):
+		s = "+Inf"
+	case math.IsInf(v, -1):
+		s = "-Inf"
+	case math.IsNaN(v):
+		s = "NaN"
+	default:
+		s = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	fmt.Fprintf(p, "%s %s\n", name, s)
+}
+
+// gauge writes a metric family with a single unlabeled gauge.
+func (p promWriter) gauge(name, help string, v float64) {
+	p.family(name, "gauge", help)
+	p.sample(name, v)
+}
+
+// counter writes a metric family with a single unlabeled counter.
+func (p promWriter) counter(name, help string, v float64) {
+	p.family(name, "counter", help)
+	p.sample(name, v)
+}
+
+// loopMetrics writes the current conditions from a loop packet.  Fields
+// that were flagged by quality control are left out.
+func loopMetrics(p promWriter, l loop) {
+	for _, m := range []struct {
+		name  string
+		help  string
+		field string // Quality control field
+		v     float64
+	}{
+		{"davis_barometer_altimeter_inches", "Altimeter setting in inches of mercury.", "barometer.altimeter", l.Bar.Altimeter},
+		{"davis_barometer_sea_level_inches", "Sea level pressure in inches of mercury.", "barometer.seaLevel", l.Bar.SeaLevel},
+		{"davis_barometer_station_inches", "Station pressure in inches of mercury.", "barometer.station", l.Bar.Station},
+		{"davis_console_battery_volts", "Console battery voltage.", "", l.Bat.ConsoleVoltage},
+		{"davis_dew_point_fahrenheit", "Dew point in degrees Fahrenheit.", "dewPoint", l.DewPoint},
+		{"davis_heat_index_fahrenheit", "Heat index in degrees Fahrenheit.", "heatIndex", l.HeatIndex},
+		{"davis_inside_humidity_percent", "Inside relative humidity.", "insideHumidity", float64(l.InHumidity)},
+		{"davis_inside_temperature_fahrenheit", "Inside temperature in degrees Fahrenheit.", "insideTemperature", l.InTemp},
+		{"davis_outside_humidity_percent", "Outside relative humidity.", "outsideHumidity", float64(l.OutHumidity)},
+		{"davis_outside_temperature_fahrenheit", "Outside temperature in degrees Fahrenheit.", "outsideTemperature", l.OutTemp},
+		{"davis_rain_last_hour_inches", "Rain accumulation in the last hour in inches.", "rain.accumulation.lastHour", l.Rain.Accum.LastHour},
+		{"davis_rain_rate_inches_per_hour", "Rain rate in inches per hour.", "rain.rate", l.Rain.Rate},
+		{"davis_rain_today_inches", "Rain accumulation today in inches.", "rain.accumulation.today", l.Rain.Accum.Today},
+		{"davis_solar_radiation_watts_per_square_meter", "Solar radiation in watts per square meter.", "solarRadiation", float64(l.SolarRad)},
+		{"davis_uv_index", "UV index.", "UVIndex", l.UVIndex},
+		{"davis_wind_chill_fahrenheit", "Wind chill in degrees Fahrenheit.", "windChill", l.WindChill},
+		{"davis_wind_direction_degrees", "Current wind direction in degrees.", "wind.current.direction", float64(l.Wind.Cur.Dir)},
+		{"davis_wind_gust_mph", "Highest wind gust in the last 10 minutes in miles per hour.", "wind.gust.last10MinutesSpeed", l.Wind.Gust.Last10MinSpeed},
+		{"davis_wind_speed_mph", "Current wind speed in miles per hour.", "wind.current.speed", float64(l.Wind.Cur.Speed)},
+		{"davis_wind_speed_average_mph", "Average wind speed in the last 10 minutes in miles per hour.", "wind.average.last10MinutesSpeed", l.Wind.Avg.Last10MinSpeed},
+	} {
+		if _, bad := l.Flags[m.field]; bad {
+			continue
+		}
+		p.gauge(m.name, m.help, m.v)
+	}
+
+	p.family("davis_transmitter_battery_low", "gauge", "Transmitters with a low battery.")
+	for _, t := range l.Bat.TransLow {
+		p.sample("davis_transmitter_battery_low", 1, "transmitter", strconv.Itoa(t))
+	}
+}
+
+// metrics writes all of the server metrics.
+func (sc serverCtx) metrics(w io.Writer) {
+	p := promWriter{w}
+
+	// Current conditions
+	numLoops, lastLoop := sc.lb.last()
+	if numLoops >= loopsMin {
+		loopMetrics(p, lastLoop)
+		p.gauge("davis_last_loop_age_seconds", "Seconds since the last loop packet was received.",
+			time.Since(lastLoop.Timestamp).Seconds())
+	}
+
+	// Quality control
+	qc := sc.qs.report(time.Now()).Total
+	p.counter("davis_loops_received_total", "Loop packets received from the station.", float64(qc.Received))
+	p.counter("davis_loops_flagged_total", "Loop packets with fields flagged by quality control.", float64(qc.Flagged))
+	p.counter("davis_loops_rejected_total", "Loop packets rejected by quality control.", float64(qc.Rejected))
+	p.family("davis_qc_failures_total", "counter", "Quality control failures by rule.")
+	for _, r := range []qcRule{ruleRange, ruleTemporal, ruleConsistency, ruleClearSky} {
+		p.sample("davis_qc_failures_total", float64(qc.Rules[string(r)]), "rule", string(r))
+	}
+
+	// Archive
+	p.counter("davis_archive_records_added_total", "Archive records added to the database.",
+		float64(sc.ms.archiveAdded.Load()))
+
+	// Events broker
+	eb := sc.eb.Stats()
+	p.gauge("davis_events_subscribers", "Events broker subscribers.", float64(len(eb.Subscribers)))
+	p.counter("davis_events_dropped_total", "Events dropped because a subscriber's queue was full.", float64(eb.Dropped))
+	p.counter("davis_events_evicted_total", "Subscribers evicted for falling too far behind.", float64(eb.Evicted))
+
+	// Telnet
+	p.gauge("davis_telnet_sessions", "Open telnet sessions.", float64(sc.ts.count()))
+
+	// HTTP
+	sc.ms.Lock()
+	defer sc.ms.Unlock()
+
+	routes := make([]string, 0, len(sc.ms.http))
+	for r := range sc.ms.http {
+		routes = append(routes, r)
+	}
+	sort.Strings(routes)
+
+	p.family("davis_http_requests_total", "counter", "HTTP requests by route and status code.")
+	for _, r := range routes {
+		codes := make([]int, 0, len(sc.ms.http[r].codes))
+		for c := range sc.ms.http[r].codes {
+			codes = append(codes, c)
+		}
+		sort.Ints(codes)
+		for _, c := range codes {
+			p.sample("davis_http_requests_total", float64(sc.ms.http[r].codes[c]),
+				"route", r, "code", strconv.Itoa(c))
+		}
+	}
+
+	p.family("davis_http_request_duration_seconds", "histogram", "HTTP request durations by route.")
+	for _, r := range routes {
+		rm := sc.ms.http[r]
+		for i, le := range httpDurationBuckets {
+			p.sample("davis_http_request_duration_seconds_bucket", float64(rm.buckets[i]),
+				"route", r, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		p.sample("davis_http_request_duration_seconds_bucket", float64(rm.count), "route", r, "le", "+Inf")
+		p.sample("davis_http_request_duration_seconds_sum", rm.sum, "route", r)
+		p.sample("davis_http_request_duration_seconds_count", float64(rm.count), "route", r)
+	}
+}
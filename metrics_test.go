@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromWriter(t *testing.T) {
+	a := assert.New(t)
+
+	var b bytes.Buffer
+	p := promWriter{&b}
+	p.gauge("test_gauge", "A gauge.", 1.5)
+	p.family("test_labels", "counter", "Labels.")
+	p.sample("test_labels", 2, "a", `x"y\z`, "b", "1\n2")
+	p.sample("test_labels", math.Inf(1))
+
+	a.Equal(`# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_labels Labels.
+# TYPE test_labels counter
+test_labels{a="x\"y\\z",b="1\n2"} 2
+test_labels +Inf
+`, b.String())
+}
+
+func TestServerMetrics(t *testing.T) {
+	a := assert.New(t)
+
+	sc := serverCtx{
+		lb: &loopBuffer{},
+		eb: events.New(),
+		qs: newQCStats(),
+		ts: newTelnetSessions(),
+		ms: newServerMetrics(),
+	}
+
+	l := loop{Timestamp: time.Now(), Flags: map[string]string{"outsideTemperature": "range"}}
+	l.OutTemp = 150.0
+	l.InTemp = 70.5
+	l.Bat.TransLow = []int{2}
+	for i := 0; i < loopsMin; i++ {
+		sc.lb.add(l)
+	}
+	sc.ms.archiveAdded.Add(3)
+	sc.ms.request("/loop", 200, 30*time.Millisecond)
+	sc.ms.request("/loop", 503, 2*time.Second)
+
+	var b bytes.Buffer
+	sc.metrics(&b)
+	s := b.String()
+
+	a.Contains(s, "davis_inside_temperature_fahrenheit 70.5\n")
+	a.NotContains(s, "davis_outside_temperature_fahrenheit", "Flagged fields are left out")
+	a.Contains(s, `davis_transmitter_battery_low{transmitter="2"} 1`)
+	a.Contains(s, "davis_archive_records_added_total 3\n")
+	a.Contains(s, "davis_events_subscribers 0\n")
+	a.Contains(s, "davis_telnet_sessions 0\n")
+	a.Contains(s, `davis_http_requests_total{route="/loop",code="200"} 1`)
+	a.Contains(s, `davis_http_requests_total{route="/loop",code="503"} 1`)
+	a.Contains(s, `davis_http_request_duration_seconds_bucket{route="/loop",le="0.025"} 0`)
+	a.Contains(s, `davis_http_request_duration_seconds_bucket{route="/loop",le="0.05"} 1`)
+	a.Contains(s, `davis_http_request_duration_seconds_bucket{route="/loop",le="2.5"} 2`)
+	a.Contains(s, `davis_http_request_duration_seconds_bucket{route="/loop",le="+Inf"} 2`)
+	a.Contains(s, `davis_http_request_duration_seconds_count{route="/loop"} 2`)
+}
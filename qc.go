@@ -6,69 +6,386 @@ package main
 
 // Weather station data Quality Control checks.
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ebarkie/weatherlink/data"
+)
+
+// twilight is how long before sunrise and after sunset there may still
+// be measurable solar radiation.
+const twilight = 30 * time.Minute
+
+// qcRule is a category of QC check.
+type qcRule string
+
+// QC rules.
+const (
+	ruleRange       qcRule = "range"
+	ruleTemporal    qcRule = "temporal"
+	ruleConsistency qcRule = "consistency"
+	ruleClearSky    qcRule = "clearSky"
+)
+
+// qcError is a failed QC check.  It records which rule failed and for
+// what field so consumers can distinguish between failure types.
+type qcError struct {
+	rule  qcRule
+	field string
+	msg   string
+}
+
+func (e qcError) Error() string {
+	return fmt.Sprintf("%s check, %s", e.rule, e.msg)
+}
 
 // qualityControl stores the QC results.
 type qualityControl struct {
-	errs   []error
-	passed bool
+	errs    []qcError
+	passed  bool
+	checked int      // Number of fields that were range checked
+	lim     qcLimits // Limits the checks use
+}
+
+// add merges the results of another QC check into this one.
+func (qc *qualityControl) add(o qualityControl) {
+	qc.errs = append(qc.errs, o.errs...)
+	qc.passed = qc.passed && o.passed
+	qc.checked += o.checked
+}
+
+// rejected returns true if so many fields failed that the whole packet
+// is suspect rather than an individual sensor.
+func (qc qualityControl) rejected() bool {
+	fields := map[string]bool{}
+	for _, err := range qc.errs {
+		fields[err.field] = true
+	}
+
+	return len(fields) > 0 && len(fields)*2 >= qc.checked
+}
+
+// errors returns the error messages of the failed checks.
+func (qc qualityControl) errors() (msgs []string) {
+	for _, err := range qc.errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	return
+}
+
+// failed returns true if any of the checks for the rule failed.
+func (qc qualityControl) failed(r qcRule) bool {
+	for _, err := range qc.errs {
+		if err.rule == r {
+			return true
+		}
+	}
+
+	return false
 }
 
-// assertRange implements simple min/max range checks.
-func (qc *qualityControl) assertRange(f string, v float64, min float64, max float64) {
-	if v < min || v > max {
-		qc.errs = append(qc.errs, fmt.Errorf("range check, %f < (%s) < %f, failed for value: %f", min, f, max, v))
+// flags returns the fields that failed and the first rule each failed.
+func (qc qualityControl) flags() map[string]string {
+	if len(qc.errs) < 1 {
+		return nil
+	}
+
+	flags := make(map[string]string)
+	for _, err := range qc.errs {
+		if _, ok := flags[err.field]; !ok {
+			flags[err.field] = string(err.rule)
+		}
+	}
+
+	return flags
+}
+
+// flag marks each of the fields that failed in the loop's quality flags.
+// Optional sensors that failed are also nulled out so they're not mistaken
+// for good readings.
+func (qc qualityControl) flag(l *loop) {
+	l.Flags = qc.flags()
+	for f := range l.Flags {
+		if v := l.sensor(f); v != nil {
+			*v = nil
+		}
+	}
+}
+
+// assertConsistent implements internal consistency checks between related
+// fields.  The condition is what's expected to be true.
+func (qc *qualityControl) assertConsistent(f string, cond bool, format string, a ...interface{}) {
+	if !cond {
+		qc.errs = append(qc.errs, qcError{
+			rule:  ruleConsistency,
+			field: f,
+			msg:   fmt.Sprintf("(%s) %s", f, fmt.Sprintf(format, a...)),
+		})
+	}
+}
+
+// assertRange implements simple min/max range checks using the field's
+// limits.  Fields without limits aren't checked.
+func (qc *qualityControl) assertRange(f string, v float64) {
+	l, ok := qc.lim.get(f)
+	if !ok {
+		return
+	}
+
+	qc.checked++
+	if v < l.Min || v > l.Max {
+		qc.errs = append(qc.errs, qcError{
+			rule:  ruleRange,
+			field: f,
+			msg:   fmt.Sprintf("%f < (%s) < %f, failed for value: %f", l.Min, f, l.Max, v),
+		})
+	}
+}
+
+// assertSensors range checks each of the optional sensors that are present.
+func (qc *qualityControl) assertSensors(f string, vs []*int) {
+	for i, v := range vs {
+		if v != nil {
+			qc.assertRange(fmt.Sprintf("%s[%d]", f, i), float64(*v))
+		}
 	}
 }
 
-// validityCheck takes a Loop packet and performs a validity check using NOAA
-// criteria.  A qualityControl struct is returned indicating if it passed or not.
-// If it failed a slice of error descriptions are included.
-func validityCheck(l loop) (qc qualityControl) {
+// assertStep implements temporal (rate of change) checks using the field's
+// limits.  The allowed change is a fixed step, which allows for sensor
+// resolution and noise, plus the rate per hour for the time that elapsed
+// between the samples.  Fields without temporal limits aren't checked.
+func (qc *qualityControl) assertStep(f string, v float64, prev float64, elapsed time.Duration) {
+	l, ok := qc.lim.get(f)
+	if !ok || (l.Step == 0 && l.Rate == 0) {
+		return
+	}
+
+	max := l.Step + l.Rate*elapsed.Hours()
+	if math.Abs(v-prev) > max {
+		qc.errs = append(qc.errs, qcError{
+			rule:  ruleTemporal,
+			field: f,
+			msg:   fmt.Sprintf("|change| (%s) < %f, failed for value: %f (previous: %f)", f, max, v, prev),
+		})
+	}
+}
+
+// stepSensors temporally checks each of the optional sensors that are
+// present in both samples.
+func (qc *qualityControl) stepSensors(f string, vs []*int, prevs []*int, elapsed time.Duration) {
+	for i, v := range vs {
+		if v != nil && i < len(prevs) && prevs[i] != nil {
+			qc.assertStep(fmt.Sprintf("%s[%d]", f, i), float64(*v), float64(*prevs[i]), elapsed)
+		}
+	}
+}
+
+// stepLoop temporally checks a loop field against the most recent value in
+// the loop history that wasn't flagged as suspect.  Comparing against a
+// flagged value would let a persistent glitch pass from its second packet
+// on.
+func (qc *qualityControl) stepLoop(f string, l loop, ls []loop, v func(loop) float64) {
+	for _, prev := range ls {
+		if _, ok := prev.Flags[f]; !ok {
+			qc.assertStep(f, v(l), v(prev), l.Timestamp.Sub(prev.Timestamp))
+			return
+		}
+	}
+}
+
+// stepLoopSensors temporally checks each of the optional sensors that are
+// present against the most recent reading in the loop history.  Flagged
+// sensor readings are nulled out so they're skipped.
+func (qc *qualityControl) stepLoopSensors(f string, l loop, ls []loop, vs func(loop) []*int) {
+	for i, v := range vs(l) {
+		if v == nil {
+			continue
+		}
+		for _, prev := range ls {
+			if p := vs(prev)[i]; p != nil {
+				qc.assertStep(fmt.Sprintf("%s[%d]", f, i), float64(*v), float64(*p), l.Timestamp.Sub(prev.Timestamp))
+				break
+			}
+		}
+	}
+}
+
+// validityCheck takes a Loop packet and performs a validity check using the
+// range limits and NOAA internal consistency criteria.  A qualityControl
+// struct is returned indicating if it passed or not.  If it failed a slice
+// of error descriptions are included.
+func validityCheck(l loop, lim qcLimits) (qc qualityControl) {
+	qc.lim = lim
+
+	// Range checks
+	qc.assertRange("barometer.altimeter", l.Bar.Altimeter)
+	qc.assertRange("barometer.station", l.Bar.Station)
+	qc.assertRange("barometer.seaLevel", l.Bar.SeaLevel)
+	qc.assertRange("dewPoint", l.DewPoint)
+	qc.assertRange("insideHumidity", float64(l.InHumidity))
+	qc.assertRange("outsideHumidity", float64(l.OutHumidity))
+	qc.assertRange("insideTemperature", l.InTemp)
+	qc.assertRange("outsideTemperature", l.OutTemp)
+	qc.assertRange("rain.accumulation.last15Minutes", l.Rain.Accum.Last15Min)
+	qc.assertRange("rain.accumulation.lastHour", l.Rain.Accum.LastHour)
+	qc.assertRange("rain.accumulation.last24Hours", l.Rain.Accum.Last24Hours)
+	qc.assertRange("rain.accumulation.today", l.Rain.Accum.Today)
+	qc.assertRange("wind.current.direction", float64(l.Wind.Cur.Dir))
+	qc.assertRange("wind.current.speed", float64(l.Wind.Cur.Speed))
+
+	qc.assertSensors("extraHumidity", l.ExtraHumidity[:])
+	qc.assertSensors("extraTemperature", l.ExtraTemp[:])
+	qc.assertSensors("leafTemperature", l.LeafTemp[:])
+	qc.assertSensors("leafWetness", l.LeafWetness[:])
+	qc.assertSensors("soilMoisture", l.SoilMoist[:])
+	qc.assertSensors("soilTemperature", l.SoilTemp[:])
+
 	// National Set of Validity Check Tolerances, Internal Consistency
 	// Algorithms and Temporal Check Tolerances by Physical Element and
 	// Observation System.
 	//
 	// AWIPS Document Number TSP-032-1992R2
 
-	// Altimeter: 6.8in - 32.5in
-	qc.assertRange("Barometer (altimeter)", l.Bar.Altimeter, 6.8, 32.5)
-	qc.assertRange("Barometer (station)", l.Bar.Station, 6.8, 32.5)
+	// Dew point can't exceed the air temperature.  The console reports it
+	// as a whole number so allow for rounding.
+	qc.assertConsistent("dewPoint", l.DewPoint <= l.OutTemp+1.0,
+		"%f exceeds outside air temperature %f", l.DewPoint, l.OutTemp)
 
-	// Pressure (sea-level): 25.0in - 32.5in
-	qc.assertRange("Barometer (sea-level)", l.Bar.SeaLevel, 25.0, 32.5)
+	// Heat index is only defined for hot and humid air, where it's never
+	// lower than the air temperature.  In hot, dry air it's legitimately
+	// below it so it isn't checked.  The console reports it as a whole
+	// number so allow for rounding.
+	if l.OutTemp >= 80.0 && l.OutHumidity >= 40 {
+		qc.assertConsistent("heatIndex", l.HeatIndex >= l.OutTemp-2.0,
+			"%f is below outside air temperature %f", l.HeatIndex, l.OutTemp)
+	}
 
-	// Dew point: -80.0F - 90.0F
-	qc.assertRange("Dew point", l.DewPoint, -80.0, 90.0)
+	// Wind chill is never higher than the air temperature.
+	qc.assertConsistent("windChill", l.WindChill <= l.OutTemp+1.0,
+		"%f exceeds outside air temperature %f", l.WindChill, l.OutTemp)
 
-	// Relative humidity: 0% - 100%
-	qc.assertRange("Inside humidity", float64(l.InHumidity), 0, 100)
-	qc.assertRange("Outside humidity", float64(l.OutHumidity), 0, 100)
+	// A non-zero rain rate requires a recent bucket tip.
+	qc.assertConsistent("rain.rate", l.Rain.Rate == 0 || l.Rain.Accum.Last15Min > 0,
+		"%f with no accumulation in the last 15m", l.Rain.Rate)
 
-	// Air temperature: -60.0F - 130.0F
-	qc.assertRange("Inside air temperature", l.InTemp, -60.0, 130.0)
-	qc.assertRange("Outside air temperature", l.OutTemp, -60.0, 130.0)
+	// The 10 minute gust includes the current wind speed.
+	qc.assertConsistent("wind.gust.last10MinutesSpeed", l.Wind.Gust.Last10MinSpeed >= float64(l.Wind.Cur.Speed),
+		"%f is lower than current wind speed %d", l.Wind.Gust.Last10MinSpeed, l.Wind.Cur.Speed)
 
-	// Accumulated precipitation: 0in - 44in
-	qc.assertRange("Rain accumulation (last 15m)", l.Rain.Accum.Last15Min, 0, 44)
-	qc.assertRange("Rain accumulation (last 1h)", l.Rain.Accum.LastHour, 0, 44)
-	qc.assertRange("Rain accumulation (last 24h)", l.Rain.Accum.Last24Hours, 0, 44)
-	qc.assertRange("Rain accumulation (today)", l.Rain.Accum.Today, 0, 44)
+	// Solar radiation is zero at night.  Allow some time around sunrise and
+	// sunset for twilight.
+	if !l.Sunrise.IsZero() && !l.Sunset.IsZero() && !l.Timestamp.IsZero() {
+		night := l.Timestamp.Before(l.Sunrise.Add(-twilight)) || l.Timestamp.After(l.Sunset.Add(twilight))
+		qc.assertConsistent("solarRadiation", !night || l.SolarRad == 0,
+			"%d w/m² at night", l.SolarRad)
+	}
 
-	// Soil temperature: -40.0F - 150.0F
-	for i, v := range l.SoilTemp {
-		if v != nil {
-			qc.assertRange(fmt.Sprintf("Soil temperature #%d", i), float64(*v), -40, 150)
-		}
+	if len(qc.errs) > 0 {
+		qc.passed = false
+	} else {
+		qc.passed = true
+	}
+
+	return
+}
+
+// temporalCheck takes a Loop packet and compares each field to its most
+// recent unflagged value in the loop history using the temporal limits.
+// Changes that are too large to be physically possible, like a sensor
+// glitch, fail.  A qualityControl struct is returned indicating if it
+// passed or not.  If it failed a slice of error descriptions are included.
+func temporalCheck(l loop, ls []loop, lim qcLimits) (qc qualityControl) {
+	qc.lim = lim
+
+	// The history is empty at startup so there is nothing to compare with.
+	if len(ls) < 1 {
+		qc.passed = true
+		return
 	}
+	qc.stepLoop("barometer.altimeter", l, ls, func(l loop) float64 { return l.Bar.Altimeter })
+	qc.stepLoop("barometer.station", l, ls, func(l loop) float64 { return l.Bar.Station })
+	qc.stepLoop("barometer.seaLevel", l, ls, func(l loop) float64 { return l.Bar.SeaLevel })
+	qc.stepLoop("dewPoint", l, ls, func(l loop) float64 { return l.DewPoint })
+	qc.stepLoop("insideHumidity", l, ls, func(l loop) float64 { return float64(l.InHumidity) })
+	qc.stepLoop("outsideHumidity", l, ls, func(l loop) float64 { return float64(l.OutHumidity) })
+	qc.stepLoop("insideTemperature", l, ls, func(l loop) float64 { return l.InTemp })
+	qc.stepLoop("outsideTemperature", l, ls, func(l loop) float64 { return l.OutTemp })
+
+	qc.stepLoopSensors("extraHumidity", l, ls, func(l loop) []*int { return l.ExtraHumidity[:] })
+	qc.stepLoopSensors("extraTemperature", l, ls, func(l loop) []*int { return l.ExtraTemp[:] })
+	qc.stepLoopSensors("leafTemperature", l, ls, func(l loop) []*int { return l.LeafTemp[:] })
+	qc.stepLoopSensors("soilTemperature", l, ls, func(l loop) []*int { return l.SoilTemp[:] })
 
-	// Wind direction: 0deg - 360deg
-	qc.assertRange("Wind direction (current)", float64(l.Wind.Cur.Dir), 0, 360)
+	// Wind is naturally gusty and solar radiation changes with every
+	// passing cloud so they're not checked.
 
-	// Wind speed: 0mph - 287.695mph
-	qc.assertRange("Wind speed (current)", float64(l.Wind.Cur.Speed), 0, 287.695)
+	if len(qc.errs) > 0 {
+		qc.passed = false
+	} else {
+		qc.passed = true
+	}
+
+	return
+}
+
+// archiveCheck takes an archive record and performs a validity check using
+// the range limits and internal consistency criteria and a temporal check
+// against the previous record, if there is one.  A qualityControl struct is
+// returned indicating if it passed or not.  If it failed a slice of error
+// descriptions are included.
+func archiveCheck(a data.Archive, as []data.Archive, lim qcLimits) (qc qualityControl) {
+	qc.lim = lim
+
+	// Range checks
+	qc.assertRange("barometer", a.Bar)
+	qc.assertRange("insideHumidity", float64(a.InHumidity))
+	qc.assertRange("outsideHumidity", float64(a.OutHumidity))
+	qc.assertRange("insideTemperature", a.InTemp)
+	qc.assertRange("outsideTemperature", a.OutTemp)
+	qc.assertRange("outsideTemperatureHigh", a.OutTempHi)
+	qc.assertRange("outsideTemperatureLow", a.OutTempLow)
+	qc.assertRange("rainAccumulation", a.RainAccum)
+	qc.assertRange("windDirectionHigh", float64(a.WindDirHi))
+	qc.assertRange("windDirectionPrevailing", float64(a.WindDirPrevail))
+	qc.assertRange("windSpeedAverage", float64(a.WindSpeedAvg))
+	qc.assertRange("windSpeedHigh", float64(a.WindSpeedHi))
+
+	qc.assertSensors("extraHumidity", a.ExtraHumidity[:])
+	qc.assertSensors("extraTemperature", a.ExtraTemp[:])
+	qc.assertSensors("leafTemperature", a.LeafTemp[:])
+	qc.assertSensors("leafWetness", a.LeafWetness[:])
+	qc.assertSensors("soilMoisture", a.SoilMoist[:])
+	qc.assertSensors("soilTemperature", a.SoilTemp[:])
+
+	// Averages must fall between the interval lows and highs.
+	qc.assertConsistent("outsideTemperature", a.OutTempLow <= a.OutTemp && a.OutTemp <= a.OutTempHi,
+		"%f is outside of interval low %f and high %f", a.OutTemp, a.OutTempLow, a.OutTempHi)
+	qc.assertConsistent("windSpeedHigh", a.WindSpeedAvg <= a.WindSpeedHi,
+		"%d is lower than average wind speed %d", a.WindSpeedHi, a.WindSpeedAvg)
+	qc.assertConsistent("solarRadiationHigh", a.SolarRad <= a.SolarRadHi,
+		"%d is lower than average solar radiation %d", a.SolarRadHi, a.SolarRad)
+	qc.assertConsistent("UVIndexHigh", a.UVIndexAvg <= a.UVIndexHi,
+		"%f is lower than average UV index %f", a.UVIndexHi, a.UVIndexAvg)
+
+	// Compare to the previous record
+	if len(as) > 0 {
+		prev := as[0]
+		elapsed := a.Timestamp.Sub(prev.Timestamp)
+
+		qc.assertStep("barometer", a.Bar, prev.Bar, elapsed)
+		qc.assertStep("insideHumidity", float64(a.InHumidity), float64(prev.InHumidity), elapsed)
+		qc.assertStep("outsideHumidity", float64(a.OutHumidity), float64(prev.OutHumidity), elapsed)
+		qc.assertStep("insideTemperature", a.InTemp, prev.InTemp, elapsed)
+		qc.assertStep("outsideTemperature", a.OutTemp, prev.OutTemp, elapsed)
+		qc.stepSensors("extraTemperature", a.ExtraTemp[:], prev.ExtraTemp[:], elapsed)
+		qc.stepSensors("soilTemperature", a.SoilTemp[:], prev.SoilTemp[:], elapsed)
+	}
 
-	if qc.errs != nil {
+	if len(qc.errs) > 0 {
 		qc.passed = false
 	} else {
 		qc.passed = true
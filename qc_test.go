@@ -6,7 +6,9 @@ package main
 
 import (
 	"testing"
+	"time"
 
+	"github.com/ebarkie/weatherlink/data"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,7 +17,7 @@ func TestLoopValidity(t *testing.T) {
 
 	// Invalid uninitialized loop packet
 	l := loop{}
-	qc := validityCheck(l)
+	qc := validityCheck(l, defaultLimits)
 	a.False(qc.passed, "Uninitialized packet fails validity check")
 	a.NotNil(qc.errs, "Uninitialized packet should have errors")
 	for _, err := range qc.errs {
@@ -27,13 +29,204 @@ func TestLoopValidity(t *testing.T) {
 	l.Bar.Altimeter = 6.8
 	l.Bar.SeaLevel = 25.0
 	l.Bar.Station = 6.8
-	qc = validityCheck(l)
+	qc = validityCheck(l, defaultLimits)
 	a.True(qc.passed, "Valid packet passes validity check")
 	a.Nil(qc.errs, "Valid packet has no errors")
 
 	// Invalid temperature
 	l.DewPoint = 65535.0
-	qc = validityCheck(l)
+	qc = validityCheck(l, defaultLimits)
 	a.False(qc.passed, "Bad dew point fails validity check")
 	a.NotNil(qc.errs, "Bad dew point has an error message")
+	a.True(qc.failed(ruleRange), "Bad dew point fails range check")
+}
+
+func TestLoopConsistency(t *testing.T) {
+	a := assert.New(t)
+
+	l := loop{Timestamp: time.Date(2006, time.January, 2, 22, 4, 5, 0, time.UTC)}
+	l.Bar.Altimeter = 30.0
+	l.Bar.SeaLevel = 30.0
+	l.Bar.Station = 29.0
+	l.OutTemp = 50.0
+	l.DewPoint = 45.0
+	l.HeatIndex = 50.0
+	l.WindChill = 48.0
+	l.Wind.Cur.Speed = 5
+	l.Wind.Gust.Last10MinSpeed = 12.0
+	l.Sunrise = time.Date(2006, time.January, 2, 7, 15, 0, 0, time.UTC)
+	l.Sunset = time.Date(2006, time.January, 2, 17, 45, 0, 0, time.UTC)
+
+	qc := validityCheck(l, defaultLimits)
+	a.True(qc.passed, "Consistent packet passes validity check")
+
+	// In hot, dry air the heat index is well below the temperature
+	dry := l
+	dry.OutTemp, dry.OutHumidity, dry.DewPoint, dry.HeatIndex = 100.0, 10, 33.0, 95.0
+	qc = validityCheck(dry, defaultLimits)
+	a.True(qc.passed, "Hot, dry packet passes validity check")
+
+	// Each of these is within range but inconsistent with another field
+	tests := []struct {
+		desc string
+		f    func(l *loop)
+	}{
+		{"Dew point above temperature", func(l *loop) { l.DewPoint = 55.0 }},
+		{"Heat index below temperature", func(l *loop) {
+			l.OutTemp, l.OutHumidity, l.DewPoint, l.HeatIndex = 90.0, 60, 75.0, 80.0
+		}},
+		{"Wind chill above temperature", func(l *loop) { l.WindChill = 60.0 }},
+		{"Rain rate without accumulation", func(l *loop) { l.Rain.Rate = 0.25 }},
+		{"Gust below current speed", func(l *loop) { l.Wind.Cur.Speed = 20 }},
+		{"Solar radiation at night", func(l *loop) { l.SolarRad = 400 }},
+	}
+
+	for _, test := range tests {
+		bad := l
+		test.f(&bad)
+		qc = validityCheck(bad, defaultLimits)
+		a.False(qc.passed, test.desc)
+		a.True(qc.failed(ruleConsistency), test.desc+" fails consistency check")
+		a.False(qc.failed(ruleRange), test.desc+" passes range check")
+	}
+}
+
+func TestLoopTemporal(t *testing.T) {
+	a := assert.New(t)
+
+	prev := loop{Timestamp: time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)}
+	prev.Bar.Altimeter = 30.0
+	prev.Bar.SeaLevel = 30.0
+	prev.Bar.Station = 29.0
+	prev.OutTemp = 50.0
+	prev.OutHumidity = 60
+
+	// No history
+	l := prev
+	l.Timestamp = prev.Timestamp.Add(2 * time.Second)
+	qc := temporalCheck(l, nil, defaultLimits)
+	a.True(qc.passed, "Packet with no history passes temporal check")
+
+	// Small change
+	l.OutTemp = 50.5
+	qc = temporalCheck(l, []loop{prev}, defaultLimits)
+	a.True(qc.passed, "Small change passes temporal check")
+	a.Nil(qc.errs, "Small change has no errors")
+
+	// Single packet glitch
+	l.OutTemp = 75.0
+	l.OutHumidity = 5
+	qc = temporalCheck(l, []loop{prev}, defaultLimits)
+	a.False(qc.passed, "Temperature jump fails temporal check")
+	a.Equal(2, len(qc.errs), "Temperature and humidity jumps both fail")
+
+	// The same change is plausible over a longer period of time
+	l.Timestamp = prev.Timestamp.Add(2 * time.Hour)
+	qc = temporalCheck(l, []loop{prev}, defaultLimits)
+	a.True(qc.passed, "Gradual change passes temporal check")
+
+	// A persistent glitch keeps failing because each packet is compared
+	// to the last good value rather than the flagged one.
+	history := []loop{prev}
+	for i := 1; i <= 2; i++ {
+		l = prev
+		l.Timestamp = prev.Timestamp.Add(time.Duration(i) * 2 * time.Second)
+		l.OutTemp = 75.0
+		qc = temporalCheck(l, history, defaultLimits)
+		a.False(qc.passed, "Persistent temperature jump fails temporal check")
+		a.Equal(1, len(qc.errs), "Only temperature jump fails")
+		qc.flag(&l)
+		history = append([]loop{l}, history...)
+	}
+
+	// Once the sensor recovers it passes against the last good value.
+	l = prev
+	l.Timestamp = prev.Timestamp.Add(6 * time.Second)
+	l.OutTemp = 50.5
+	qc = temporalCheck(l, history, defaultLimits)
+	a.True(qc.passed, "Recovered temperature passes temporal check")
+
+	// Optional sensors are also compared to the last good reading.
+	good, bad := 55, 90
+	prev.SoilTemp[0] = &good
+	history = []loop{prev}
+	for i := 1; i <= 2; i++ {
+		l = prev
+		l.Timestamp = prev.Timestamp.Add(time.Duration(i) * 2 * time.Second)
+		l.SoilTemp[0] = &bad
+		qc = temporalCheck(l, history, defaultLimits)
+		a.False(qc.passed, "Persistent soil temperature jump fails temporal check")
+		qc.flag(&l)
+		a.Nil(l.SoilTemp[0], "Soil temperature jump is nulled out")
+		history = append([]loop{l}, history...)
+	}
+}
+
+func TestLoopFlags(t *testing.T) {
+	a := assert.New(t)
+
+	l := loop{}
+	l.Bar.Altimeter = 30.0
+	l.Bar.SeaLevel = 30.0
+	l.Bar.Station = 29.0
+	l.Wind.Cur.Speed = 10
+	l.Wind.Gust.Last10MinSpeed = 15.0
+	good, bad := 55, 200
+	l.SoilTemp[0] = &good
+	l.SoilTemp[1] = &bad
+
+	// A broken auxiliary sensor is flagged and nulled out but the rest of
+	// the packet is kept.
+	qc := validityCheck(l, defaultLimits)
+	a.False(qc.passed, "Bad soil temperature fails validity check")
+	a.False(qc.rejected(), "Bad soil temperature doesn't reject packet")
+	qc.flag(&l)
+	a.Equal(map[string]string{"soilTemperature[1]": "range"}, l.Flags, "Bad soil temperature is flagged")
+	a.Nil(l.SoilTemp[1], "Bad soil temperature is nulled out")
+	a.Equal(&good, l.SoilTemp[0], "Good soil temperature is kept")
+	a.Equal(10, l.Wind.Cur.Speed, "Wind speed is kept")
+
+	// A packet that's mostly garbage is rejected.
+	l = loop{}
+	l.Bar.Altimeter = 65535.0
+	l.Bar.SeaLevel = 65535.0
+	l.Bar.Station = 65535.0
+	l.DewPoint = 65535.0
+	l.InHumidity = 255
+	l.OutHumidity = 255
+	l.InTemp = 65535.0
+	l.OutTemp = 65535.0
+	qc = validityCheck(l, defaultLimits)
+	a.True(qc.rejected(), "Garbage packet is rejected")
+}
+
+func TestArchiveCheck(t *testing.T) {
+	a := assert.New(t)
+
+	prev := data.Archive{Timestamp: time.Date(2006, time.January, 2, 15, 0, 0, 0, time.UTC)}
+	prev.Bar = 30.0
+	prev.OutTemp = 50.0
+	prev.OutTempHi = 51.0
+	prev.OutTempLow = 49.0
+	prev.OutHumidity = 60
+
+	rec := prev
+	rec.Timestamp = prev.Timestamp.Add(5 * time.Minute)
+	qc := archiveCheck(rec, []data.Archive{prev}, defaultLimits)
+	a.True(qc.passed, "Valid record passes archive check")
+	a.Nil(qc.flags(), "Valid record has no flags")
+
+	// Average outside of the interval low and high
+	rec.OutTemp = 55.0
+	qc = archiveCheck(rec, nil, defaultLimits)
+	a.False(qc.passed, "Inconsistent record fails archive check")
+	a.True(qc.failed(ruleConsistency), "Inconsistent record fails consistency check")
+
+	// Large jump from the previous record
+	rec.OutTempHi = 80.0
+	rec.OutTemp = 79.0
+	rec.OutTempLow = 78.0
+	qc = archiveCheck(rec, []data.Archive{prev}, defaultLimits)
+	a.False(qc.passed, "Temperature jump fails archive check")
+	a.Equal(map[string]string{"outsideTemperature": "temporal"}, qc.flags(), "Temperature jump is flagged")
 }
@@ -0,0 +1,190 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// Quality Control limits and loading them from a configuration file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// qcLimit is the valid range and temporal tolerances for a field.  The
+// step is the change that's always allowed between samples and the rate is
+// the additional change allowed per hour.  If both are zero then the field
+// isn't temporally checked.  Persist is the number of hours a sensor can
+// report the same value before it's considered stuck.  If it's zero then
+// the field isn't checked for persistence.
+type qcLimit struct {
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Step    float64 `json:"step,omitempty"`
+	Rate    float64 `json:"rate,omitempty"`
+	Persist float64 `json:"persist,omitempty"`
+}
+
+// persist returns the persistence limit as a duration.
+func (l qcLimit) persist() time.Duration {
+	return time.Duration(l.Persist * float64(time.Hour))
+}
+
+// qcLimits maps field JSON paths to their limits.  Indexed fields, like
+// "soilTemperature[1]", use the limits for all indexes, "soilTemperature",
+// unless they have their own.
+type qcLimits map[string]qcLimit
+
+// defaultLimits are the National Set of Validity Check Tolerances and
+// Temporal Check Tolerances by Physical Element and Observation System.
+// Persistence limits are how long a sensor with the console's resolution
+// can plausibly stay exactly the same.
+//
+// AWIPS Document Number TSP-032-1992R2
+var defaultLimits = qcLimits{
+	// Altimeter: 6.8in - 32.5in, 0.02in + 0.3in/hour
+	"barometer.altimeter": {Min: 6.8, Max: 32.5, Step: 0.02, Rate: 0.3},
+	"barometer.station":   {Min: 6.8, Max: 32.5, Step: 0.02, Rate: 0.3},
+
+	// Pressure (sea-level): 25.0in - 32.5in, 0.02in + 0.3in/hour, 12 hours
+	"barometer":          {Min: 25.0, Max: 32.5, Step: 0.02, Rate: 0.3, Persist: 12},
+	"barometer.seaLevel": {Min: 25.0, Max: 32.5, Step: 0.02, Rate: 0.3},
+
+	// Dew point: -80.0F - 90.0F, 2.0F + 35.0F/hour
+	"dewPoint": {Min: -80.0, Max: 90.0, Step: 2.0, Rate: 35.0},
+
+	// Relative humidity: 0% - 100%, 5% + 50%/hour, 48 hours
+	"extraHumidity":   {Min: 0, Max: 100, Step: 5, Rate: 50, Persist: 48},
+	"insideHumidity":  {Min: 0, Max: 100, Step: 5, Rate: 50, Persist: 48},
+	"outsideHumidity": {Min: 0, Max: 100, Step: 5, Rate: 50, Persist: 48},
+
+	// Air temperature: -60.0F - 130.0F, 2.0F + 35.0F/hour, 12-24 hours
+	"extraTemperature":       {Min: -60.0, Max: 130.0, Step: 2.0, Rate: 35.0, Persist: 24},
+	"insideTemperature":      {Min: -60.0, Max: 130.0, Step: 2.0, Rate: 35.0, Persist: 24},
+	"outsideTemperature":     {Min: -60.0, Max: 130.0, Step: 2.0, Rate: 35.0, Persist: 12},
+	"outsideTemperatureHigh": {Min: -60.0, Max: 130.0},
+	"outsideTemperatureLow":  {Min: -60.0, Max: 130.0},
+
+	// Leaf temperature: -40.0F - 150.0F, 2.0F + 35.0F/hour
+	"leafTemperature": {Min: -40.0, Max: 150.0, Step: 2.0, Rate: 35.0},
+
+	// Leaf wetness: 0 - 15
+	"leafWetness": {Min: 0, Max: 15},
+
+	// Accumulated precipitation: 0in - 44in
+	"rain.accumulation.last15Minutes": {Min: 0, Max: 44},
+	"rain.accumulation.lastHour":      {Min: 0, Max: 44},
+	"rain.accumulation.last24Hours":   {Min: 0, Max: 44},
+	"rain.accumulation.today":         {Min: 0, Max: 44},
+	"rainAccumulation":                {Min: 0, Max: 44},
+
+	// Soil moisture: 0cb - 200cb
+	"soilMoisture": {Min: 0, Max: 200},
+
+	// Soil temperature: -40.0F - 150.0F, 2.0F + 10.0F/hour
+	"soilTemperature": {Min: -40.0, Max: 150.0, Step: 2.0, Rate: 10.0},
+
+	// Wind direction: 0deg - 360deg, 24 hours while it's windy
+	"wind.current.direction":  {Min: 0, Max: 360},
+	"windDirectionHigh":       {Min: 0, Max: 360},
+	"windDirectionPrevailing": {Min: 0, Max: 360, Persist: 24},
+
+	// Wind speed: 0mph - 287.695mph, 48 hours
+	"wind.current.speed": {Min: 0, Max: 287.695},
+	"windSpeedAverage":   {Min: 0, Max: 287.695, Persist: 48},
+	"windSpeedHigh":      {Min: 0, Max: 287.695},
+}
+
+// get returns the limits for a field.  If the field doesn't have any
+// limits then ok is false.
+func (lim qcLimits) get(f string) (l qcLimit, ok bool) {
+	l, ok = lim[f]
+	if !ok {
+		if i := strings.IndexByte(f, '['); i > 0 {
+			l, ok = lim[f[:i]]
+		}
+	}
+
+	return
+}
+
+// validIndex returns false if the field has an index that isn't an
+// optional sensor, like "soilTemperature[4]", or isn't written the way the
+// checks look it up, like "soilTemperature[02]".  Fields without an index
+// are valid.
+func validIndex(f string) bool {
+	name, index, ok := strings.Cut(f, "[")
+	if !ok {
+		return true
+	}
+	i, err := strconv.Atoi(strings.TrimSuffix(index, "]"))
+	if err != nil || f != fmt.Sprintf("%s[%d]", name, i) {
+		return false
+	}
+
+	return (&loop{}).sensor(f) != nil
+}
+
+// loadLimits reads a QC configuration file and returns the default limits
+// with the file's limits applied over them.  The file is a JSON object of
+// field paths and their limits, like:
+//
+//	{
+//	  "barometer.station": {"min": 18.0, "max": 25.0},
+//	  "soilTemperature[2]": {"min": 50.0, "max": 110.0, "step": 1.0, "rate": 5.0, "persist": 72}
+//	}
+//
+// Only the attributes that are specified are changed.
+func loadLimits(file string) (qcLimits, error) {
+	lim := qcLimits{}
+	for f, l := range defaultLimits {
+		lim[f] = l
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(b, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorting applies the limits for all indexes, like "soilTemperature",
+	// before the limits for a specific index, like "soilTemperature[2]".
+	keys := make([]string, 0, len(fields))
+	for f := range fields {
+		keys = append(keys, f)
+	}
+	sort.Strings(keys)
+
+	for _, f := range keys {
+		// Start with the current limits for the field, which may be
+		// inherited from the limits for all indexes.
+		l, ok := lim.get(f)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s", f)
+		}
+		if !validIndex(f) {
+			return nil, fmt.Errorf("field %s: invalid sensor index", f)
+		}
+
+		err = json.Unmarshal(fields[f], &l)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", f, err.Error())
+		}
+		if l.Min > l.Max {
+			return nil, fmt.Errorf("field %s: min %f exceeds max %f", f, l.Min, l.Max)
+		}
+		lim[f] = l
+	}
+
+	return lim, nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadLimits(t *testing.T) {
+	a := assert.New(t)
+
+	file := filepath.Join(t.TempDir(), "qc.json")
+	err := os.WriteFile(file, []byte(`{
+		"barometer.station": {"min": 18.0, "max": 25.0},
+		"soilTemperature": {"max": 120.0},
+		"soilTemperature[2]": {"min": 50.0, "step": 1.0}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lim, err := loadLimits(file)
+	a.Nil(err, "Limits file loads")
+
+	l, _ := lim.get("barometer.station")
+	a.Equal(qcLimit{Min: 18.0, Max: 25.0, Step: 0.02, Rate: 0.3}, l, "Range is changed and temporal is kept")
+
+	l, _ = lim.get("soilTemperature[0]")
+	a.Equal(qcLimit{Min: -40.0, Max: 120.0, Step: 2.0, Rate: 10.0}, l, "Index uses limits for all indexes")
+
+	l, _ = lim.get("soilTemperature[2]")
+	a.Equal(qcLimit{Min: 50.0, Max: 120.0, Step: 1.0, Rate: 10.0}, l, "Index uses its own limits")
+
+	l, _ = defaultLimits.get("soilTemperature[2]")
+	a.Equal(-40.0, l.Min, "Default limits are unchanged")
+
+	// Unknown fields are most likely typos
+	err = os.WriteFile(file, []byte(`{"soilTemp": {"max": 120.0}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadLimits(file)
+	a.NotNil(err, "Unknown field fails to load")
+
+	// Indexes must be optional sensors that exist
+	for _, f := range []string{"soilTemperature[99]", "soilTemperature[x]", "soilTemperature[-1]",
+		"soilTemperature[02]", "soilTemperature[2", "outsideTemperature[0]"} {
+		err = os.WriteFile(file, []byte(`{"`+f+`": {"max": 120.0}}`), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadLimits(file)
+		a.NotNil(err, f)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// Quality Control statistics.
+
+import (
+	"sync"
+	"time"
+)
+
+const qcStatsWindow = 24 * time.Hour // Longest rolling window
+
+// qcCounts are the number of loop packets that were received and how they
+// fared in quality control.  Failures are counted once per packet for each
+// rule and field that failed.
+type qcCounts struct {
+	Received int64            `json:"received"`
+	Passed   int64            `json:"passed"`
+	Flagged  int64            `json:"flagged"`
+	Rejected int64            `json:"rejected"`
+	Rules    map[string]int64 `json:"rules"`
+	Fields   map[string]int64 `json:"fields"`
+}
+
+// add adds another set of counts to these counts.
+func (c *qcCounts) add(o qcCounts) {
+	c.Received += o.Received
+	c.Passed += o.Passed
+	c.Flagged += o.Flagged
+	c.Rejected += o.Rejected
+	if c.Rules == nil {
+		c.Rules = map[string]int64{}
+	}
+	for r, n := range o.Rules {
+		c.Rules[r] += n
+	}
+	if c.Fields == nil {
+		c.Fields = map[string]int64{}
+	}
+	for f, n := range o.Fields {
+		c.Fields[f] += n
+	}
+}
+
+// count counts a loop packet's QC results.
+func (c *qcCounts) count(qc qualityControl) {
+	c.Received++
+	switch {
+	case qc.rejected():
+		c.Rejected++
+	case qc.passed:
+		c.Passed++
+	default:
+		c.Flagged++
+	}
+
+	rules := map[string]bool{}
+	fields := map[string]bool{}
+	for _, err := range qc.errs {
+		rules[string(err.rule)] = true
+		fields[err.field] = true
+	}
+	if c.Rules == nil {
+		c.Rules = map[string]int64{}
+	}
+	for r := range rules {
+		c.Rules[r]++
+	}
+	if c.Fields == nil {
+		c.Fields = map[string]int64{}
+	}
+	for f := range fields {
+		c.Fields[f]++
+	}
+}
+
+// qcStatsBucket is the counts for one minute.
+type qcStatsBucket struct {
+	minute int64
+	counts qcCounts
+}
+
+// qcStats tracks QC counts since the server started and over rolling
+// windows.  The rolling windows are calculated from one minute buckets.
+type qcStats struct {
+	start   time.Time
+	total   qcCounts
+	buckets [qcStatsWindow / time.Minute]qcStatsBucket
+	sync.RWMutex
+}
+
+// qcStatsReport is a snapshot of the QC statistics.
+type qcStatsReport struct {
+	Since       time.Time `json:"since"`
+	Total       qcCounts  `json:"total"`
+	LastHour    qcCounts  `json:"lastHour"`
+	Last24Hours qcCounts  `json:"last24Hours"`
+}
+
+// newQCStats returns new QC statistics starting now.
+func newQCStats() *qcStats {
+	return &qcStats{start: time.Now()}
+}
+
+// add counts a loop packet's QC results that was received at time t.
+func (s *qcStats) add(t time.Time, qc qualityControl) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.total.count(qc)
+
+	m := t.Unix() / 60
+	b := &s.buckets[m%int64(len(s.buckets))]
+	if b.minute != m {
+		*b = qcStatsBucket{minute: m}
+	}
+	b.counts.count(qc)
+}
+
+// window returns the counts over the duration before time t.
+func (s *qcStats) window(t time.Time, d time.Duration) (c qcCounts) {
+	c.add(qcCounts{}) // Empty maps instead of nil
+
+	now := t.Unix() / 60
+	for _, b := range s.buckets {
+		if b.minute > now-int64(d/time.Minute) && b.minute <= now {
+			c.add(b.counts)
+		}
+	}
+
+	return
+}
+
+// report returns a snapshot of the QC statistics as of time t.
+func (s *qcStats) report(t time.Time) (r qcStatsReport) {
+	s.RLock()
+	defer s.RUnlock()
+
+	r.Since = s.start
+	r.Total.add(s.total)
+	r.LastHour = s.window(t, time.Hour)
+	r.Last24Hours = s.window(t, 24*time.Hour)
+
+	return
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQCStats(t *testing.T) {
+	a := assert.New(t)
+
+	now := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	s := newQCStats()
+
+	passed := qualityControl{passed: true, checked: 4}
+	flagged := qualityControl{checked: 4, errs: []qcError{
+		{rule: ruleRange, field: "outsideTemperature"},
+		{rule: ruleTemporal, field: "outsideTemperature"},
+	}}
+	rejected := qualityControl{checked: 4, errs: []qcError{
+		{rule: ruleRange, field: "barometer.altimeter"},
+		{rule: ruleRange, field: "barometer.seaLevel"},
+	}}
+
+	s.add(now.Add(-2*time.Hour), rejected)
+	s.add(now.Add(-30*time.Minute), flagged)
+	s.add(now, passed)
+	s.add(now, passed)
+
+	r := s.report(now)
+	a.Equal(int64(4), r.Total.Received)
+	a.Equal(int64(2), r.Total.Passed)
+	a.Equal(int64(1), r.Total.Flagged)
+	a.Equal(int64(1), r.Total.Rejected)
+	a.Equal(int64(2), r.Total.Rules["range"], "Range failures are counted once per packet")
+	a.Equal(int64(1), r.Total.Rules["temporal"])
+	a.Equal(int64(1), r.Total.Fields["outsideTemperature"], "Field failures are counted once per packet")
+
+	a.Equal(int64(3), r.LastHour.Received, "Last hour excludes older packets")
+	a.Equal(int64(0), r.LastHour.Rejected)
+	a.Equal(int64(4), r.Last24Hours.Received)
+
+	// Buckets that are reused are reset
+	r = s.report(now.Add(24 * time.Hour))
+	a.Equal(int64(0), r.Last24Hours.Received, "Old packets roll out of the window")
+	s.add(now.Add(24*time.Hour), passed)
+	r = s.report(now.Add(24 * time.Hour))
+	a.Equal(int64(1), r.Last24Hours.Received)
+	a.Equal(int64(5), r.Total.Received)
+}
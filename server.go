@@ -5,7 +5,12 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/ebarkie/davis-station/internal/archive"
@@ -17,6 +22,8 @@ const (
 	loopsMin     = 3               // Minimum number of samples received before responding
 	loopsMax     = 2 * 135         // Store up to about 10 minutes of loop sample history
 	loopStaleAge = 5 * time.Minute // Stop responding if most recent loop sample was > 5 minutes
+
+	shutdownTimeout = 10 * time.Second // Maximum time to wait for each server to stop
 )
 
 // Errors.
@@ -33,6 +40,13 @@ type serverCtx struct {
 	eb *events.Broker
 	wl *weatherlink.Conn
 
+	lim qcLimits
+	stn stationInfo
+	hl  *sensorHealth
+	qs  *qcStats
+	ts  *telnetSessions
+	ms  *serverMetrics
+
 	startTime time.Time
 
 	firmBuildTime time.Time
@@ -40,6 +54,22 @@ type serverCtx struct {
 }
 
 func server(cfg config) {
+	// Shutdown gracefully when interrupted or terminated
+	sig, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Load quality control limits
+	lim := defaultLimits
+	if cfg.qc != "" {
+		var err error
+		lim, err = loadLimits(cfg.qc)
+		if err != nil {
+			Error.Fatalf("Unable to load quality control file %s: %s", cfg.qc, err.Error())
+		}
+	}
+
 	// Open archive database
 	ar, err := archive.Open(cfg.db)
 	if err != nil {
@@ -56,8 +86,14 @@ func server(cfg config) {
 	sc := serverCtx{
 		ar:        &ar,
 		lb:        &loopBuffer{},
-		eb:        events.New(),
+		eb:        events.NewContext(ctx),
 		wl:        &wl,
+		lim:       lim,
+		stn:       cfg.stn,
+		hl:        &sensorHealth{},
+		qs:        newQCStats(),
+		ts:        newTelnetSessions(),
+		ms:        newServerMetrics(),
 		startTime: time.Now(),
 	}
 
@@ -72,13 +108,47 @@ func server(cfg config) {
 	}
 
 	// Start weather station events handler
-	go stationEvents(sc)
-
-	// Start HTTP server
-	go httpServer(sc, cfg)
-
-	// Start Telnet server
-	go telnetServer(sc, cfg)
+	stationDone := make(chan struct{})
+	go func() {
+		defer close(stationDone)
+		stationEvents(sc)
+	}()
+
+	// Start special weather report generator
+	go speciEvents(sc)
+
+	// Start HTTP and Telnet servers
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		httpServer(ctx, sc, cfg)
+	}()
+	go func() {
+		defer wg.Done()
+		telnetServer(ctx, sc, cfg)
+	}()
+
+	<-sig.Done()
+	stop() // A second signal terminates immediately
+	Info.Println("Shutting down")
+
+	// The events broker is closed with the context which ends event
+	// streams so the servers can finish.
+	cancel()
+	wg.Wait()
+
+	// Stop the weather station so nothing else is written to the archive
+	// database before it's closed.
+	err = sc.wl.Close()
+	if err != nil {
+		Warn.Printf("Unable to close Weatherlink: %s", err.Error())
+	}
+	select {
+	case <-stationDone:
+	case <-time.After(shutdownTimeout):
+		Warn.Println("Timed out waiting for Weatherlink events to stop")
+	}
 
-	select {}
+	Info.Println("Shutdown complete")
 }
@@ -0,0 +1,224 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// SPECI special weather reports for significant changes in the weather.
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/ebarkie/davis-station/internal/events"
+	"github.com/ebarkie/weatherlink/packet"
+	"github.com/ebarkie/weatherlink/units"
+)
+
+const (
+	speciHistory = 15 * time.Minute // Wind shifts are evaluated over 15 minutes
+
+	windShiftDir   = 45.0 // Degrees
+	windShiftSpeed = 10.0 // Knots sustained throughout the shift
+
+	squallIncrease = 16.0 // Knots
+	squallSpeed    = 22.0 // Knots sustained for at least 1 minute
+)
+
+// speciWatcher watches the loop packets for significant changes in the
+// weather that require a special report.
+type speciWatcher struct {
+	ls      []loop // Loop history in ascending order
+	started bool
+	raining bool
+	trend   string
+	squall  bool
+}
+
+// knots returns the current and 2 minute average wind speeds in knots.
+func knots(l loop) (cur, avg float64) {
+	cur = units.Speed(float64(l.Wind.Cur.Speed) * units.MPH).Knots()
+	avg = units.Speed(l.Wind.Avg.Last2MinSpeed * units.MPH).Knots()
+
+	return
+}
+
+// meanDir returns the mean wind direction of the loop packets in the
+// period ending at time t.  If there are no packets then ok is false.
+func meanDir(ls []loop, t time.Time, d time.Duration) (dir float64, ok bool) {
+	var u, v float64
+	for _, l := range ls {
+		if l.Timestamp.After(t) || !l.Timestamp.After(t.Add(-d)) {
+			continue
+		}
+		r := float64(l.Wind.Cur.Dir) * math.Pi / 180
+		u, v = u+math.Sin(r), v+math.Cos(r)
+		ok = true
+	}
+	dir = math.Mod(math.Atan2(u, v)*180/math.Pi+360, 360)
+
+	return
+}
+
+// windShift returns true if the 2 minute mean wind direction changed by 45
+// degrees or more within the last 15 minutes while the sustained wind speed
+// was 10 knots or more.
+func (w *speciWatcher) windShift(now time.Time) bool {
+	cur, ok := meanDir(w.ls, now, 2*time.Minute)
+	if !ok {
+		return false
+	}
+
+	for back := 2 * time.Minute; back <= speciHistory-2*time.Minute; back += time.Minute {
+		begin := now.Add(-back - 2*time.Minute)
+		if w.ls[0].Timestamp.After(begin) {
+			break
+		}
+
+		// The wind has to be sustained throughout the shift.
+		sustained := true
+		for _, l := range w.ls {
+			if _, avg := knots(l); !l.Timestamp.Before(begin) && avg < windShiftSpeed {
+				sustained = false
+				break
+			}
+		}
+		if !sustained {
+			break
+		}
+
+		prev, ok := meanDir(w.ls, now.Add(-back), 2*time.Minute)
+		if !ok {
+			continue
+		}
+		if diff := math.Abs(cur - prev); math.Min(diff, 360-diff) >= windShiftDir {
+			return true
+		}
+	}
+
+	return false
+}
+
+// squallBegan returns true if the wind speed suddenly increased by 16 knots
+// or more and has been sustained at 22 knots or more for at least 1 minute.
+func (w *speciWatcher) squallBegan(now time.Time) bool {
+	if w.ls[0].Timestamp.After(now.Add(-3 * time.Minute)) {
+		return false
+	}
+
+	sustained, before := math.Inf(1), math.Inf(1)
+	for _, l := range w.ls {
+		cur, _ := knots(l)
+		switch {
+		case l.Timestamp.After(now.Add(-time.Minute)):
+			sustained = math.Min(sustained, cur)
+		case l.Timestamp.After(now.Add(-3 * time.Minute)):
+			before = math.Min(before, cur)
+		}
+	}
+
+	if sustained < squallSpeed {
+		w.squall = false
+		return false
+	}
+	if w.squall || sustained-before < squallIncrease {
+		return false
+	}
+	w.squall = true
+
+	return true
+}
+
+// check adds a loop packet to the history and returns the reasons a special
+// report is required, if any.
+func (w *speciWatcher) check(l loop) (reasons []string) {
+	// Add to the history and purge old packets
+	w.ls = append(w.ls, l)
+	i := 0
+	for i < len(w.ls) && l.Timestamp.Sub(w.ls[i].Timestamp) > speciHistory {
+		i++
+	}
+	w.ls = w.ls[i:]
+
+	if w.windShift(l.Timestamp) {
+		reasons = append(reasons, "wind shift")
+
+		// Start over so the same shift isn't reported again.
+		w.ls = w.ls[len(w.ls)-1:]
+	}
+
+	if w.squallBegan(l.Timestamp) {
+		reasons = append(reasons, "squall")
+	}
+
+	// Precipitation and pressure changes are relative to the previous
+	// packet so there's nothing to compare the first one with.
+	raining := l.Rain.Rate > 0
+	if w.started && raining != w.raining {
+		if raining {
+			reasons = append(reasons, "precipitation began")
+		} else {
+			reasons = append(reasons, "precipitation ended")
+		}
+	}
+	w.raining = raining
+
+	if w.started && l.Bar.Trend != w.trend {
+		switch l.Bar.Trend {
+		case packet.RisingRapid:
+			reasons = append(reasons, "pressure rising rapidly")
+		case packet.FallingRapid:
+			reasons = append(reasons, "pressure falling rapidly")
+		}
+	}
+	w.trend = l.Bar.Trend
+	w.started = true
+
+	return
+}
+
+// speciEvents watches the loop packets on the events broker and generates
+// special weather reports.  Reports are stored in the database and
+// published to the events broker.
+func speciEvents(sc serverCtx) {
+	w := speciWatcher{}
+
+	for {
+		ec := sc.eb.Subscribe("speci", "loop")
+		for e := range ec {
+			l, ok := e.Data.(loop)
+			if !ok {
+				continue
+			}
+
+			reasons := w.check(l)
+			if len(reasons) < 1 {
+				continue
+			}
+
+			s := archive.Speci{
+				Timestamp: l.Timestamp,
+				Report:    "SPECI" + strings.TrimPrefix(sc.report(l), "METAR"),
+				Reasons:   reasons,
+			}
+			Info.Printf("SPECI %s: %s", strings.Join(reasons, ", "), s.Report)
+
+			err := sc.ar.AddSpeci(s)
+			if err != nil {
+				Error.Printf("Unable to add SPECI to database: %s", err.Error())
+			}
+
+			sc.eb.Publish(events.Event{Name: "speci", Data: s})
+		}
+
+		select {
+		case <-sc.eb.Done():
+			return
+		default:
+			// Evicted for falling too far behind so start over.
+			Warn.Println("SPECI fell too far behind, resubscribing")
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/ebarkie/weatherlink/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpeciWindShift(t *testing.T) {
+	a := assert.New(t)
+
+	w := speciWatcher{}
+	l := loop{Timestamp: time.Date(2006, time.January, 2, 15, 0, 0, 0, time.UTC)}
+	l.Wind.Cur.Speed = 15
+	l.Wind.Avg.Last2MinSpeed = 15.0
+
+	// Steady southerly wind then a shift to the west over a few minutes
+	var shifted time.Time
+	for i := 0; i < 15*24; i++ {
+		l.Timestamp = l.Timestamp.Add(2500 * time.Millisecond)
+		l.Wind.Cur.Dir = 180
+		if i >= 8*24 {
+			l.Wind.Cur.Dir = 260
+		}
+		if reasons := w.check(l); len(reasons) > 0 {
+			a.Equal([]string{"wind shift"}, reasons)
+			a.True(shifted.IsZero(), "Wind shift is only reported once")
+			shifted = l.Timestamp
+		}
+	}
+	a.False(shifted.IsZero(), "Wind shift is reported")
+
+	// Light winds don't shift
+	w = speciWatcher{}
+	l.Wind.Cur.Speed = 5
+	l.Wind.Avg.Last2MinSpeed = 5.0
+	for i := 0; i < 15*24; i++ {
+		l.Timestamp = l.Timestamp.Add(2500 * time.Millisecond)
+		l.Wind.Cur.Dir = 180
+		if i >= 8*24 {
+			l.Wind.Cur.Dir = 260
+		}
+		a.Empty(w.check(l), "Light wind shift isn't reported")
+	}
+}
+
+func TestSpeciSquall(t *testing.T) {
+	a := assert.New(t)
+
+	w := speciWatcher{}
+	l := loop{Timestamp: time.Date(2006, time.January, 2, 15, 0, 0, 0, time.UTC)}
+
+	var squalls int
+	for i := 0; i < 10*24; i++ {
+		l.Timestamp = l.Timestamp.Add(2500 * time.Millisecond)
+		l.Wind.Cur.Speed = 5
+		if i >= 5*24 {
+			l.Wind.Cur.Speed = 35
+		}
+		for _, r := range w.check(l) {
+			if r == "squall" {
+				squalls++
+			}
+		}
+	}
+	a.Equal(1, squalls, "Squall is reported once")
+}
+
+func TestSpeciChanges(t *testing.T) {
+	a := assert.New(t)
+
+	w := speciWatcher{}
+	l := loop{Timestamp: time.Date(2006, time.January, 2, 15, 0, 0, 0, time.UTC)}
+	l.Rain.Rate = 0.10
+	l.Bar.Trend = packet.FallingRapid
+	a.Empty(w.check(l), "First packet has nothing to compare with")
+
+	l.Timestamp = l.Timestamp.Add(2500 * time.Millisecond)
+	a.Empty(w.check(l), "No changes")
+
+	l.Timestamp = l.Timestamp.Add(2500 * time.Millisecond)
+	l.Rain.Rate = 0
+	a.Equal([]string{"precipitation ended"}, w.check(l))
+
+	l.Timestamp = l.Timestamp.Add(2500 * time.Millisecond)
+	l.Rain.Rate = 0.02
+	l.Bar.Trend = packet.RisingRapid
+	a.Equal([]string{"precipitation began", "pressure rising rapidly"}, w.check(l))
+}
+
+func TestSpeciHistory(t *testing.T) {
+	a := assert.New(t)
+
+	ar, err := archive.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+	c := httpCtx{ar: &ar}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.specis(w, httptest.NewRequest("GET", "/speci/history"+query, nil))
+		return w
+	}
+
+	w := get("")
+	a.Equal(http.StatusNoContent, w.Code, "No reports")
+
+	w = get("?begin=yesterday")
+	a.Equal(http.StatusBadRequest, w.Code)
+	a.NotEmpty(w.Header().Get("Warning"))
+
+	ts := time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+	for _, m := range []int{0, 15, 90} {
+		err := ar.AddSpeci(archive.Speci{Timestamp: ts.Add(time.Duration(m) * time.Minute), Report: "SPECI"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w = get("?begin=2016-06-01T12:00:00Z&end=2016-06-01T13:00:00Z")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	var ss []archive.Speci
+	a.Nil(json.Unmarshal(w.Body.Bytes(), &ss))
+	if a.Len(ss, 2) {
+		a.True(ts.Add(15 * time.Minute).Equal(ss[0].Timestamp))
+		a.True(ts.Equal(ss[1].Timestamp))
+	}
+}
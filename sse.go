@@ -0,0 +1,181 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// Server-sent events ids and replay of missed events.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/ebarkie/davis-station/internal/events"
+)
+
+const (
+	sseRetry     = 3 * time.Second // Reconnection time hint sent to clients
+	sseReplayMax = 24 * time.Hour  // Maximum archive history replayed on reconnect
+)
+
+// eventCursor is the position of the last loop and archive events sent to
+// an events stream client and the units the client wants them in.
+type eventCursor struct {
+	seq   int64
+	t     time.Time
+	units unitSystem
+}
+
+// newEventCursor creates a cursor positioned before any events.
+func newEventCursor(u unitSystem) eventCursor {
+	return eventCursor{seq: -1, units: u}
+}
+
+// eventID returns the id clients use to resume an events stream after an
+// event.  Loops use their sequence and archive records use their timestamp.
+// Other events don't have one, so clients keep the previous id.
+func eventID(e events.Event) string {
+	switch d := e.Data.(type) {
+	case loop:
+		return strconv.FormatInt(d.Seq, 10)
+	case archive.Record:
+		return d.Timestamp.Format(time.RFC3339)
+	}
+
+	return ""
+}
+
+// eventTime returns the timestamp of a loop or archive event.
+func eventTime(e events.Event) time.Time {
+	switch d := e.Data.(type) {
+	case loop:
+		return d.Timestamp
+	case archive.Record:
+		return d.Timestamp
+	}
+
+	return time.Time{}
+}
+
+// sent returns true if the event was already sent to the client, which
+// happens when a live event was also replayed.
+func (cur eventCursor) sent(e events.Event) bool {
+	switch d := e.Data.(type) {
+	case loop:
+		return d.Seq <= cur.seq
+	case archive.Record:
+		return !d.Timestamp.After(cur.t)
+	}
+
+	return false
+}
+
+// advance moves the cursor past an event.  It never moves backwards so
+// events that are sent again on request don't cause duplicates.
+func (cur *eventCursor) advance(e events.Event) {
+	switch d := e.Data.(type) {
+	case loop:
+		if d.Seq > cur.seq {
+			cur.seq = d.Seq
+		}
+	case archive.Record:
+		if d.Timestamp.After(cur.t) {
+			cur.t = d.Timestamp
+		}
+	}
+}
+
+// send writes an event to a Server-sent events client and advances the
+// cursor.
+func (cur *eventCursor) send(w io.Writer, e events.Event) {
+	if id := eventID(e); id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\n", e.Name)
+	r, _ := cur.units.marshal(e.Data)
+	fmt.Fprintf(w, "data: %s\n\n", r)
+
+	cur.advance(e)
+}
+
+// hold appends the events queued for a subscriber without blocking.  Live
+// events are held this way while a replay is written so a long replay
+// doesn't leave them to be dropped by the broker.
+func hold(ec chan events.Event, es []events.Event) []events.Event {
+	for {
+		select {
+		case e, ok := <-ec:
+			if !ok {
+				// Closed channels are handled by the caller
+				return es
+			}
+			es = append(es, e)
+		default:
+			return es
+		}
+	}
+}
+
+// replay returns the loop and archive events matching topics that were
+// published after the event with the specified id, in ascending order.
+// Loops are replayed from the loop buffer and archive records from the
+// database.  If the id isn't recognized then there is nothing to replay.
+func (sc serverCtx) replay(lastID string, topics []string) (es []events.Event) {
+	ls := sc.lb.loops()
+
+	var since time.Time
+	after := func(l loop) bool { return false }
+	if seq, err := strconv.ParseInt(lastID, 10, 64); err == nil {
+		// The sequence restarts with the server so ids that are ahead of
+		// it can't be resumed.
+		if len(ls) < 1 || seq > ls[0].Seq {
+			return
+		}
+
+		// If the loop was purged from the buffer then everything that's
+		// left was missed.
+		since = ls[len(ls)-1].Timestamp
+		for _, l := range ls {
+			if l.Seq == seq {
+				since = l.Timestamp
+				break
+			}
+		}
+		after = func(l loop) bool { return l.Seq > seq }
+	} else if t, err := time.Parse(time.RFC3339, lastID); err == nil {
+		since = t
+		after = func(l loop) bool { return l.Timestamp.After(t) }
+	} else {
+		return
+	}
+
+	if events.Match(topics, "loop") {
+		for _, l := range ls {
+			if after(l) {
+				es = append(es, events.Event{Name: "loop", Data: l})
+			}
+		}
+	}
+
+	if events.Match(topics, "archive") {
+		now := time.Now()
+		if min := now.Add(-sseReplayMax); since.Before(min) {
+			since = min
+		}
+		for _, rec := range sc.ar.Get(since, now) {
+			if rec.Timestamp.After(since) {
+				es = append(es, events.Event{Name: "archive", Data: rec})
+			}
+		}
+	}
+
+	sort.SliceStable(es, func(i, j int) bool {
+		return eventTime(es[i]).Before(eventTime(es[j]))
+	})
+
+	return
+}
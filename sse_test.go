@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/ebarkie/davis-station/internal/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventCursor(t *testing.T) {
+	a := assert.New(t)
+
+	ts := time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+	l := loop{Seq: 42, Timestamp: ts}
+	rec := archive.Record{}
+	rec.Timestamp = ts
+
+	a.Equal("42", eventID(events.Event{Name: "loop", Data: l}))
+	a.Equal("2016-06-01T12:00:00Z", eventID(events.Event{Name: "archive", Data: rec}))
+	a.Equal("", eventID(events.Event{Name: "stuck", Data: []stuckSensor{}}))
+
+	cur := newEventCursor(imperial)
+	a.False(cur.sent(events.Event{Name: "loop", Data: loop{Seq: 0}}))
+
+	var b bytes.Buffer
+	cur.send(&b, events.Event{Name: "loop", Data: l})
+	a.Contains(b.String(), "id: 42\nevent: loop\ndata: {")
+	a.True(cur.sent(events.Event{Name: "loop", Data: loop{Seq: 42}}))
+	a.False(cur.sent(events.Event{Name: "loop", Data: loop{Seq: 43}}))
+
+	cur.send(&b, events.Event{Name: "archive", Data: rec})
+	a.True(cur.sent(events.Event{Name: "archive", Data: rec}))
+	rec.Timestamp = ts.Add(5 * time.Minute)
+	a.False(cur.sent(events.Event{Name: "archive", Data: rec}))
+}
+
+func TestHold(t *testing.T) {
+	a := assert.New(t)
+
+	b := events.New()
+	defer b.Close()
+	ec := b.Subscribe("replaying", "loop")
+	a.Empty(hold(ec, nil))
+
+	// Live events published during a replay are held rather than left to
+	// fill the queue.
+	for i := int64(0); i < 3; i++ {
+		b.Publish(events.Event{Name: "loop", Data: loop{Seq: i}})
+	}
+	b.Subscribers()
+	es := hold(ec, nil)
+	a.Len(es, 3)
+	a.Equal(int64(2), es[2].Data.(loop).Seq)
+	a.Equal(0, b.Subscribers()[0].Queued)
+
+	// Closed channels are left for the caller.
+	b.Close()
+	<-b.Done()
+	for range ec {
+	}
+	a.Equal(es, hold(ec, es))
+}
+
+func TestReplay(t *testing.T) {
+	a := assert.New(t)
+
+	sc := serverCtx{lb: &loopBuffer{}}
+	ts := time.Now()
+	for i := int64(0); i < 5; i++ {
+		sc.lb.add(loop{Seq: i, Timestamp: ts.Add(time.Duration(i) * 2 * time.Second)})
+	}
+
+	seqs := func(es []events.Event) (s []int64) {
+		for _, e := range es {
+			s = append(s, e.Data.(loop).Seq)
+		}
+		return
+	}
+
+	loopOnly := []string{"loop"}
+	a.Empty(sc.replay("", loopOnly))
+	a.Empty(sc.replay("bogus", loopOnly))
+	a.Empty(sc.replay("99", loopOnly), "Sequence from before a restart")
+	a.Empty(sc.replay("4", loopOnly))
+	a.Equal([]int64{2, 3, 4}, seqs(sc.replay("1", loopOnly)))
+	a.Equal([]int64{3, 4}, seqs(sc.replay(ts.Add(5*time.Second).Format(time.RFC3339Nano), loopOnly)))
+	a.Empty(sc.replay("1", []string{"speci"}))
+}
+
+func TestEventsBadTopics(t *testing.T) {
+	a := assert.New(t)
+
+	w := httptest.NewRecorder()
+	httpCtx{}.events(w, httptest.NewRequest("GET", "/events?events=loop,[", nil))
+	a.Equal(http.StatusBadRequest, w.Code)
+	a.NotEmpty(w.Header().Get("Warning"))
+}
@@ -5,21 +5,68 @@
 package main
 
 import (
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ebarkie/davis-station/internal/archive"
 	"github.com/ebarkie/davis-station/internal/events"
 	"github.com/ebarkie/weatherlink"
 	"github.com/ebarkie/weatherlink/data"
 )
 
-// loop is a weatherlink.Loop with a sequence and timestamp
-// added in.
+// loop is a weatherlink.Loop with a sequence, timestamp, and
+// quality flags added in.
 type loop struct {
-	Seq       int64     `json:"sequence"`
-	Timestamp time.Time `json:"timestamp"`
+	Seq       int64             `json:"sequence"`
+	Timestamp time.Time         `json:"timestamp"`
+	Flags     map[string]string `json:"qualityFlags,omitempty"`
 	data.Loop
 }
 
+// sensor returns a pointer to the optional sensor reading identified by
+// its JSON path, like "soilTemperature[0]".  If the path isn't an optional
+// sensor then nil is returned.
+func (l *loop) sensor(path string) **int {
+	name, index, ok := strings.Cut(strings.TrimSuffix(path, "]"), "[")
+	if !ok {
+		return nil
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 {
+		return nil
+	}
+
+	var sensors []*int
+	switch name {
+	case "extraHumidity":
+		sensors = l.ExtraHumidity[:]
+	case "extraTemperature":
+		sensors = l.ExtraTemp[:]
+	case "leafTemperature":
+		sensors = l.LeafTemp[:]
+	case "leafWetness":
+		sensors = l.LeafWetness[:]
+	case "soilMoisture":
+		sensors = l.SoilMoist[:]
+	case "soilTemperature":
+		sensors = l.SoilTemp[:]
+	}
+	if i >= len(sensors) {
+		return nil
+	}
+
+	return &sensors[i]
+}
+
+// stationInfo is the station identification and location.
+type stationInfo struct {
+	ID   string   `json:"id"`
+	WMO  string   `json:"wmo"`
+	Name string   `json:"name"`
+	Loc  location `json:"location"`
+}
+
 func stationOpen(dev string) (weatherlink.Conn, error) {
 	// Connect the weatherlink loggers
 	weatherlink.Trace.SetOutput(Trace)
@@ -42,17 +89,58 @@ func stationEvents(sc serverCtx) error {
 
 	// Receive events forever
 	var seq int64
+	var sw stuckWindow
 	for e := range ec {
 		switch e := e.(type) {
 		case data.Archive:
+			// Quality control validity, clear-sky, and temporal checks
+			// against the previous record.  Records are always stored but the fields
+			// that failed are flagged.
+			var prev []data.Archive
+			if p, ok := sc.ar.Prev(e.Timestamp); ok {
+				prev = append(prev, p.Archive)
+			}
+			qc := archiveCheck(e, prev, sc.lim)
+			qc.add(archiveClearSkyCheck(e, prev, sc.stn.Loc))
+			if !qc.passed {
+				Warn.Printf("QC archive %s", qc.errs)
+			}
+			rec := archive.Record{Archive: e, Flags: qc.flags()}
+
 			// Add record to archive database
-			err := sc.ar.Add(e)
+			err := sc.ar.Add(rec)
 			if err != nil {
 				Error.Printf("Unable to add archive record to database: %s", err.Error())
+			} else {
+				sc.ms.archiveAdded.Add(1)
 			}
 
 			// Update events broker
-			sc.eb.Publish(events.Event{Name: "archive", Data: e})
+			sc.eb.Publish(events.Event{Name: "archive", Data: rec})
+
+			// Quality control persistence check for stuck sensors using the
+			// loop history and archive records.  Records downloaded to catch
+			// up aren't checked.  The window of records is read from the
+			// database once the catch up is done and then kept up to date.
+			d := sc.lim.maxPersist()
+			if sw.loaded {
+				sw.add(rec, d)
+			}
+			if time.Since(rec.Timestamp) > stuckCatchUpAge {
+				continue
+			}
+			if !sw.loaded {
+				sw.recs, sw.loaded = sc.ar.Get(rec.Timestamp.Add(-d), rec.Timestamp), true
+			}
+			stuck := stuckCheck(sc.lb.loops(), sw.recs, sc.lim)
+			if sc.hl.update(stuck) {
+				if len(stuck) > 0 {
+					Warn.Printf("QC stuck sensors %v", stuck)
+				} else {
+					Info.Println("QC stuck sensors cleared")
+				}
+				sc.eb.Publish(events.Event{Name: "stuck", Data: stuck})
+			}
 		case data.Loop:
 			// Create Loop with sequence and timestamp
 			l := loop{}
@@ -60,13 +148,30 @@ func stationEvents(sc serverCtx) error {
 			l.Seq = seq
 			l.Loop = e
 
-			// Quality control validity check
-			qc := validityCheck(l)
-			if !qc.passed {
-				// Log and ignore bad packets
-				Error.Printf("QC %s", qc.errs)
+			// Quality control validity and clear-sky checks and temporal
+			// checks against the loop history.
+			qc := validityCheck(l, sc.lim)
+			qc.add(temporalCheck(l, sc.lb.loops(), sc.lim))
+			qc.add(clearSkyCheck(l, sc.stn.Loc))
+			sc.qs.add(l.Timestamp, qc)
+			if qc.rejected() {
+				// Log and quarantine packets that are mostly bad
+				Error.Printf("QC rejected %s", qc.errs)
+				err := sc.ar.Quarantine(archive.Reject{
+					Timestamp: l.Timestamp,
+					Errors:    qc.errors(),
+					Loop:      l.Loop,
+				})
+				if err != nil {
+					Error.Printf("Unable to add rejected loop to database: %s", err.Error())
+				}
 				continue
 			}
+			if !qc.passed {
+				// Flag the bad fields and keep the good ones
+				Warn.Printf("QC %s", qc.errs)
+				qc.flag(&l)
+			}
 
 			// Update loop buffer
 			sc.lb.add(l)
@@ -75,7 +180,7 @@ func stationEvents(sc serverCtx) error {
 			sc.eb.Publish(events.Event{Name: "loop", Data: l})
 
 			// Increment loop sequence - this intentionally only occurs
-			// if it passed QC.
+			// if it wasn't rejected by QC.
 			seq++
 		default:
 			Warn.Printf("Unhandled event type: %T", e)
@@ -0,0 +1,226 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// Stuck sensor (persistence) detection.
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/ebarkie/weatherlink/data"
+)
+
+// stuckCatchUpAge is how old an archive record can be before it's considered
+// one of the missed records downloaded to catch up rather than a new one.
+const stuckCatchUpAge = time.Hour
+
+// stuckSensor is a sensor that has reported the same value for longer
+// than is physically plausible.
+type stuckSensor struct {
+	Field string    `json:"field"`
+	Value float64   `json:"value"`
+	Since time.Time `json:"since"`
+}
+
+// persistSensor is a sensor that is checked for persistence along with
+// functions to read it from loop packets and archive records.  If a reading
+// isn't available, like during calm wind for direction or a missing optional
+// sensor, then false is returned.
+type persistSensor struct {
+	field   string
+	loop    func(l loop) (float64, bool)
+	archive func(a data.Archive) (float64, bool)
+}
+
+// persistSensors returns all of the sensors that can be checked for
+// persistence.
+func persistSensors() []persistSensor {
+	sensors := []persistSensor{
+		{"barometer",
+			func(l loop) (float64, bool) { return l.Bar.SeaLevel, true },
+			func(a data.Archive) (float64, bool) { return a.Bar, true }},
+		{"insideHumidity",
+			func(l loop) (float64, bool) { return float64(l.InHumidity), true },
+			func(a data.Archive) (float64, bool) { return float64(a.InHumidity), true }},
+		{"insideTemperature",
+			func(l loop) (float64, bool) { return l.InTemp, true },
+			func(a data.Archive) (float64, bool) { return a.InTemp, true }},
+		{"outsideHumidity",
+			func(l loop) (float64, bool) { return float64(l.OutHumidity), true },
+			func(a data.Archive) (float64, bool) { return float64(a.OutHumidity), true }},
+		{"outsideTemperature",
+			func(l loop) (float64, bool) { return l.OutTemp, true },
+			func(a data.Archive) (float64, bool) { return a.OutTemp, true }},
+		{"windDirectionPrevailing",
+			func(l loop) (float64, bool) { return float64(l.Wind.Cur.Dir), l.Wind.Cur.Speed > 0 },
+			func(a data.Archive) (float64, bool) { return float64(a.WindDirPrevail), a.WindSpeedAvg > 0 }},
+		{"windSpeedAverage",
+			func(l loop) (float64, bool) { return l.Wind.Avg.Last10MinSpeed, true },
+			func(a data.Archive) (float64, bool) { return float64(a.WindSpeedAvg), true }},
+	}
+
+	// Optional sensors that are in both loop packets and archive records
+	indexed := []struct {
+		field   string
+		loop    func(l loop) []*int
+		archive func(a data.Archive) []*int
+	}{
+		{"extraHumidity",
+			func(l loop) []*int { return l.ExtraHumidity[:] },
+			func(a data.Archive) []*int { return a.ExtraHumidity[:] }},
+		{"extraTemperature",
+			func(l loop) []*int { return l.ExtraTemp[:] },
+			func(a data.Archive) []*int { return a.ExtraTemp[:] }},
+		{"soilTemperature",
+			func(l loop) []*int { return l.SoilTemp[:] },
+			func(a data.Archive) []*int { return a.SoilTemp[:] }},
+	}
+	read := func(vs []*int, i int) (float64, bool) {
+		if i >= len(vs) || vs[i] == nil {
+			return 0, false
+		}
+		return float64(*vs[i]), true
+	}
+	for _, s := range indexed {
+		s := s
+		for i := range s.loop(loop{}) {
+			i := i
+			sensors = append(sensors, persistSensor{
+				fmt.Sprintf("%s[%d]", s.field, i),
+				func(l loop) (float64, bool) { return read(s.loop(l), i) },
+				func(a data.Archive) (float64, bool) { return read(s.archive(a), i) },
+			})
+		}
+	}
+
+	return sensors
+}
+
+// maxPersist returns the longest persistence window in the limits.
+func (lim qcLimits) maxPersist() (d time.Duration) {
+	for _, l := range lim {
+		if p := l.persist(); p > d {
+			d = p
+		}
+	}
+
+	return
+}
+
+// stuckCheck looks at the loop history and archive records, both in
+// descending order, and returns the sensors that have reported an identical
+// value for longer than their persistence limit.
+func stuckCheck(ls []loop, as []archive.Record, lim qcLimits) (stuck []stuckSensor) {
+	for _, s := range persistSensors() {
+		l, ok := lim.get(s.field)
+		if !ok || l.persist() <= 0 {
+			continue
+		}
+
+		// Walk back from the most recent reading for as long as the value
+		// stays the same.  Loop packets are more recent than the archive
+		// records so they're first.
+		var cur stuckSensor
+		var latest time.Time
+		var have bool
+		same := func(t time.Time, v float64) bool {
+			if !have {
+				cur = stuckSensor{Field: s.field, Value: v, Since: t}
+				latest, have = t, true
+				return true
+			}
+			if v != cur.Value {
+				return false
+			}
+			cur.Since = t
+			return true
+		}
+
+		var oldest time.Time
+		changed := false
+		for _, l := range ls {
+			oldest = l.Timestamp
+			if v, ok := s.loop(l); ok && !same(l.Timestamp, v) {
+				changed = true
+				break
+			}
+		}
+		for _, a := range as {
+			if changed {
+				break
+			}
+			if !oldest.IsZero() && !a.Timestamp.Before(oldest) {
+				continue
+			}
+			if v, ok := s.archive(a.Archive); ok && !same(a.Timestamp, v) {
+				changed = true
+			}
+		}
+
+		if have && latest.Sub(cur.Since) >= l.persist() {
+			stuck = append(stuck, cur)
+		}
+	}
+
+	return
+}
+
+// stuckWindow holds the archive records, in descending order, that the
+// persistence check looks back over so they aren't read from the database
+// for every new record.
+type stuckWindow struct {
+	recs   []archive.Record
+	loaded bool
+}
+
+// add adds an archive record to the window and drops the records that are
+// more than d older than the most recent one.  A record with the same
+// timestamp as one in the window replaces it.
+func (w *stuckWindow) add(rec archive.Record, d time.Duration) {
+	i := sort.Search(len(w.recs), func(i int) bool { return !w.recs[i].Timestamp.After(rec.Timestamp) })
+	if i < len(w.recs) && w.recs[i].Timestamp.Equal(rec.Timestamp) {
+		w.recs[i] = rec
+	} else {
+		w.recs = append(w.recs, archive.Record{})
+		copy(w.recs[i+1:], w.recs[i:])
+		w.recs[i] = rec
+	}
+
+	begin := w.recs[0].Timestamp.Add(-d)
+	w.recs = w.recs[:sort.Search(len(w.recs), func(i int) bool { return w.recs[i].Timestamp.Before(begin) })]
+}
+
+// sensorHealth holds the sensors that are currently stuck.
+type sensorHealth struct {
+	stuck []stuckSensor
+	sync.RWMutex
+}
+
+// get returns the sensors that are currently stuck.
+func (sh *sensorHealth) get() []stuckSensor {
+	sh.RLock()
+	defer sh.RUnlock()
+
+	return sh.stuck
+}
+
+// update replaces the stuck sensors and returns true if the set of
+// sensors changed.
+func (sh *sensorHealth) update(stuck []stuckSensor) bool {
+	sh.Lock()
+	defer sh.Unlock()
+
+	changed := len(stuck) != len(sh.stuck)
+	for i := 0; !changed && i < len(stuck); i++ {
+		changed = stuck[i].Field != sh.stuck[i].Field
+	}
+	sh.stuck = stuck
+
+	return changed
+}
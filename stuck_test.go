@@ -0,0 +1,100 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStuckCheck(t *testing.T) {
+	a := assert.New(t)
+
+	lim := qcLimits{
+		"outsideHumidity":    {Min: 0, Max: 100, Persist: 24},
+		"outsideTemperature": {Min: -60.0, Max: 130.0, Persist: 12},
+		"windSpeedAverage":   {Min: 0, Max: 287.695},
+	}
+
+	// Two days of hourly archive records with humidity pinned at 100%,
+	// varying temperature, and no wind.
+	now := time.Date(2006, time.January, 2, 15, 0, 0, 0, time.UTC)
+	var as []archive.Record
+	for i := 0; i <= 48; i++ {
+		rec := archive.Record{}
+		rec.Timestamp = now.Add(-time.Duration(i) * time.Hour)
+		rec.OutHumidity = 100
+		rec.OutTemp = 50.0 + float64(i%5)
+		as = append(as, rec)
+	}
+
+	l := loop{Timestamp: now.Add(time.Minute)}
+	l.OutHumidity = 100
+	l.OutTemp = 52.0
+	ls := []loop{l}
+
+	stuck := stuckCheck(ls, as, lim)
+	a.Equal(1, len(stuck), "Only humidity is stuck")
+	if len(stuck) > 0 {
+		a.Equal("outsideHumidity", stuck[0].Field)
+		a.Equal(100.0, stuck[0].Value)
+		a.Equal(as[len(as)-1].Timestamp, stuck[0].Since, "Stuck since oldest record")
+	}
+
+	// Recovered when the latest loop changes
+	ls[0].OutHumidity = 99
+	stuck = stuckCheck(ls, as, lim)
+	a.Empty(stuck, "Changed humidity is not stuck")
+
+	// Not stuck when the history doesn't cover the persistence limit
+	ls[0].OutHumidity = 100
+	stuck = stuckCheck(ls, as[:12], lim)
+	a.Empty(stuck, "Short history is not stuck")
+
+	sh := sensorHealth{}
+	a.True(sh.update(stuckCheck(ls, as, lim)), "Newly stuck sensor changes health")
+	a.False(sh.update(stuckCheck(ls, as, lim)), "Same stuck sensor doesn't change health")
+	a.True(sh.update(nil), "Cleared sensor changes health")
+}
+
+func TestStuckWindow(t *testing.T) {
+	a := assert.New(t)
+
+	t0 := time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+	at := func(m int) time.Time { return t0.Add(time.Duration(m) * time.Minute) }
+	rec := func(m int, temp float64) (rec archive.Record) {
+		rec.Timestamp = at(m)
+		rec.OutTemp = temp
+		return
+	}
+	times := func(w stuckWindow) (ms []int) {
+		for _, rec := range w.recs {
+			ms = append(ms, int(rec.Timestamp.Sub(t0)/time.Minute))
+		}
+		return
+	}
+
+	var w stuckWindow
+	for _, m := range []int{0, 5, 10} {
+		w.add(rec(m, 50), 10*time.Minute)
+	}
+	a.Equal([]int{10, 5, 0}, times(w), "Descending order")
+
+	w.add(rec(15, 50), 10*time.Minute)
+	a.Equal([]int{15, 10, 5}, times(w), "Older records are dropped")
+
+	w.add(rec(12, 50), 10*time.Minute)
+	a.Equal([]int{15, 12, 10, 5}, times(w), "Out of order records are inserted")
+
+	w.add(rec(10, 60), 10*time.Minute)
+	a.Equal([]int{15, 12, 10, 5}, times(w))
+	a.Equal(60.0, w.recs[2].OutTemp, "Replaced records are updated")
+
+	w.add(rec(-5, 50), 10*time.Minute)
+	a.Equal([]int{15, 12, 10, 5}, times(w), "Records older than the window aren't kept")
+}
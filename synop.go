@@ -0,0 +1,145 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/ebarkie/weatherlink/units"
+)
+
+// synopPressure formats a pressure in inches as the last four digits of
+// tenths of a hectopascal.
+func synopPressure(in float64) string {
+	hpa := units.Pressure(in * units.Inches).Millibars()
+
+	return fmt.Sprintf("%04.f", math.Mod(math.Round(hpa*10), 10000))
+}
+
+// synopPrecip formats a precipitation amount in inches using WMO code table
+// 3590.
+func synopPrecip(in float64) string {
+	mm := in * 25.4
+	switch {
+	case mm <= 0.0:
+		return "000"
+	case mm < 0.05:
+		return "990" // Trace
+	case math.Round(mm*10) < 10:
+		return fmt.Sprintf("99%.f", math.Round(mm*10))
+	case mm >= 988.0:
+		return "988"
+	default:
+		return fmt.Sprintf("%03.f", mm)
+	}
+}
+
+// synopReport generates a SYNOP report for a loop packet using the server's
+// archive records.
+func (sc serverCtx) synopReport(l loop) string {
+	as := sc.ar.Get(l.Timestamp.Add(-12*time.Hour), l.Timestamp)
+
+	return synop(sc.stn.WMO, l, as)
+}
+
+// synop generates a WMO FM 12 SYNOP report string for a given Loop struct.
+// The archive records, in descending order, are used for the pressure
+// tendency, precipitation, and maximum and minimum temperatures.  If the
+// WMO station number isn't configured it's reported as missing.  Reports
+// observed shortly before the hour are for it, like METAR reports.
+func synop(wmo string, l loop, as []archive.Record) string {
+	t := l.Timestamp.In(time.UTC)
+	syn, ok := synopticHour(t, time.UTC)
+	if ok {
+		t = syn
+	}
+	six := ok && syn.Hour()%6 == 0
+
+	// Section 0
+	//
+	// Land station report with the day, hour, and wind speed in knots
+	// measured by an anemometer (iw=4).
+	s := "AAXX"
+	s += fmt.Sprintf(" %s4", t.Format("0215"))
+	if wmo == "" {
+		wmo = "/////"
+	}
+	s += " " + wmo
+
+	// Section 1
+
+	// Precipitation is reported in section 1 for the last 6 hours at the
+	// main synoptic hours and the last 3 hours otherwise.
+	d, tr := 3*time.Hour, 7
+	if six {
+		d, tr = 6*time.Hour, 1
+	}
+	var accum float64
+	for _, rec := range archiveWithin(as, t, d) {
+		if _, bad := rec.Flags["rainAccumulation"]; !bad {
+			accum += rec.RainAccum
+		}
+	}
+
+	// Precipitation indicator, automatic station without present weather
+	// (ix=6), and cloud base height and visibility not observed.
+	ir := 3
+	if accum > 0.0 {
+		ir = 1
+	}
+	s += fmt.Sprintf(" %d6///", ir)
+
+	// Total cloud cover not observed, wind direction, and wind speed
+	speed := math.Round(units.Speed(l.Wind.Avg.Last10MinSpeed * units.MPH).Knots())
+	dir := int(math.Round(float64(l.Wind.Cur.Dir)/10)) % 36
+	if dir == 0 {
+		dir = 36
+	}
+	if speed == 0 {
+		dir = 0
+	}
+	if speed < 99 {
+		s += fmt.Sprintf(" /%02d%02.f", dir, speed)
+	} else {
+		s += fmt.Sprintf(" /%02d99 00%03.f", dir, speed)
+	}
+
+	// Temperature and Dew Point
+	s += " 1" + tempGroup(l.OutTemp)
+	s += " 2" + tempGroup(l.DewPoint)
+
+	// Station and Sea Level Pressure
+	s += " 3" + synopPressure(l.Bar.Station)
+	s += " 4" + synopPressure(l.Bar.SeaLevel)
+
+	// 3-Hourly Pressure Tendency
+	if appp, ok := tendencyGroup(l, t, as); ok {
+		s += " 5" + appp
+	}
+
+	// Precipitation
+	if ir == 1 {
+		s += fmt.Sprintf(" 6%s%d", synopPrecip(accum), tr)
+	}
+
+	// Section 3
+	//
+	// Maximum and minimum temperatures over the last 12 hours at the main
+	// synoptic hours.
+	var sec3 string
+	if six {
+		if max, min, ok := tempExtremes(as, t, 12*time.Hour); ok {
+			sec3 += " 1" + tempGroup(max) + " 2" + tempGroup(min)
+		}
+	}
+	if sec3 != "" {
+		s += " 333" + sec3
+	}
+
+	return s + "="
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+)
+
+func Example_synop() {
+	// Hourly archive records with falling pressure and some recent rain
+	t := time.Date(2006, time.January, 2, 18, 0, 0, 0, time.UTC)
+	var as []archive.Record
+	for i := 0; i <= 12; i++ {
+		rec := archive.Record{}
+		rec.Timestamp = t.Add(-time.Duration(i) * time.Hour)
+		rec.Bar = 29.92 + float64(i)*0.01
+		rec.OutTempHi = 55.0 - float64(i)
+		rec.OutTempLow = 53.0 - float64(i)
+		if i < 2 {
+			rec.RainAccum = 0.02
+		}
+		as = append(as, rec)
+	}
+
+	obs := func(t time.Time, temp, dew float64, dir int, speed float64) (l loop) {
+		l.Timestamp = t
+		l.Bar.Station = 29.12
+		l.Bar.SeaLevel = 29.92
+		l.OutTemp = temp
+		l.DewPoint = dew
+		l.Wind.Cur.Dir = dir
+		l.Wind.Avg.Last10MinSpeed = speed
+		return
+	}
+
+	tests := []struct {
+		wmo string
+		l   loop
+		as  []archive.Record
+	}{
+		{"", loop{Timestamp: time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)}, nil},
+		{"72403", obs(t.Add(-time.Hour), 50.0, 41.0, 184, 12.0), nil},
+		{"72403", obs(t, 50.0, 41.0, 355, 12.0), as},
+		{"72403", obs(t.Add(-3*time.Hour), 14.0, 5.0, 90, 120.0), as},
+		{"72403", obs(t.Add(-5*time.Minute), 50.0, 41.0, 355, 12.0), as[1:]},
+		{"72403", obs(t.Add(-55*time.Minute), 50.0, 41.0, 355, 12.0), as[1:]},
+	}
+
+	for _, test := range tests {
+		fmt.Println(synop(test.wmo, test.l, test.as))
+	}
+
+	// Output:
+	// AAXX 02154 ///// 36/// /0000 11178 21178 30000 40000=
+	// AAXX 02174 72403 36/// /1810 10100 20050 39861 40132=
+	// AAXX 02184 72403 16/// /3610 10100 20050 39861 40132 57010 60011 333 10128 20056=
+	// AAXX 02154 72403 36/// /0999 00104 11100 21150 39861 40132 57020=
+	// AAXX 02184 72403 16/// /3610 10100 20050 39861 40132 57010 69951 333 10122 20056=
+	// AAXX 02174 72403 16/// /3610 10100 20050 39861 40132 57014 69957=
+}
@@ -5,13 +5,19 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
+	"github.com/ebarkie/davis-station/internal/archive"
 	"github.com/ebarkie/telnet"
 	"github.com/ebarkie/telnet/option"
 	"github.com/ebarkie/textcmd"
@@ -32,6 +38,8 @@ const (
 	del = 0x7f // Delete
 )
 
+const telnetGoodbyeWait = 2 * time.Second // Time allowed to say goodbye on shutdown
+
 // telnetCtx is the telnet context.  It includes the serverCtx,
 // parsed telnet templates, and the command rules.
 type telnetCtx struct {
@@ -40,8 +48,97 @@ type telnetCtx struct {
 	sh textcmd.Shell
 }
 
+// telnetSessions tracks the open telnet sessions so they can be closed
+// when the server shuts down.
+type telnetSessions struct {
+	conns  map[net.Conn]struct{}
+	closed bool // Sessions are no longer being added
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+}
+
+// newTelnetSessions returns a new empty set of sessions.
+func newTelnetSessions() *telnetSessions {
+	return &telnetSessions{conns: make(map[net.Conn]struct{})}
+}
+
+// add adds a session.  If the sessions have already been closed it isn't
+// added and ok is false.
+func (ts *telnetSessions) add(conn net.Conn) (ok bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.closed {
+		return false
+	}
+	ts.conns[conn] = struct{}{}
+
+	return true
+}
+
+// remove removes a session that has ended.
+func (ts *telnetSessions) remove(conn net.Conn) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	delete(ts.conns, conn)
+}
+
+// count returns the number of open sessions.
+func (ts *telnetSessions) count() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return len(ts.conns)
+}
+
+// close writes a goodbye message to all sessions and closes their
+// connections.  The goodbyes are written concurrently with a deadline so
+// stalled clients can't hold up shutdown or the other sessions.  Sessions
+// that are still negotiating aren't added afterwards.
+func (ts *telnetSessions) close(goodbye func(net.Conn)) {
+	ts.mu.Lock()
+	ts.closed = true
+	conns := make([]net.Conn, 0, len(ts.conns))
+	for conn := range ts.conns {
+		conns = append(conns, conn)
+	}
+	ts.mu.Unlock()
+
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(telnetGoodbyeWait)
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+
+			conn.SetWriteDeadline(deadline)
+			goodbye(conn)
+			conn.Close()
+		}(conn)
+	}
+	wg.Wait()
+}
+
+// wait waits up to timeout for the session goroutines to finish.  If they
+// don't then ok is false.
+func (ts *telnetSessions) wait(timeout time.Duration) (ok bool) {
+	done := make(chan struct{})
+	go func() {
+		ts.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 // telnetServer starts the telnet server.
-func telnetServer(sc serverCtx, cfg config) {
+func telnetServer(ctx context.Context, sc serverCtx, cfg config) {
 	// Inherit generic server context so we have access to things like
 	// archive records and loop packets.
 	t := telnetCtx{serverCtx: sc}
@@ -60,8 +157,13 @@ func telnetServer(sc serverCtx, cfg config) {
 	t.sh.Register(t.time, "date", "time")
 	t.sh.Register(t.health, "health")
 	t.sh.Register(t.lamps, "lamps off", "lamps on")
+	t.sh.Register(t.qc, "qc")
+	t.sh.Register(t.setUnits, "set units")
 	t.sh.Register(t.uname, "uname")
 	t.sh.Register(t.uptime, "uptime")
+	t.sh.Register(t.subscribers, "subscribers")
+	t.sh.Register(t.summary, "summary")
+	t.sh.Register(t.synop, "synop")
 	t.sh.Register(t.ver, "version")
 	t.sh.Register(t.log, "watch log debug", "watch log trace")
 	t.sh.Register(t.loop, "watch conditions", "watch loops")
@@ -75,25 +177,88 @@ func telnetServer(sc serverCtx, cfg config) {
 		Error.Fatalf("Telnet server error: %s", err.Error())
 	}
 
+	// Stop accepting new connections when the context is done and say
+	// goodbye to the active sessions.
+	go func() {
+		<-ctx.Done()
+		l.Close()
+		t.ts.close(func(conn net.Conn) {
+			t.template(conn, "shutdown", nil)
+		})
+	}()
+
 	for {
-		conn, _ := l.Accept()
-		go t.start(conn)
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			Warn.Printf("Telnet accept error: %s", err.Error())
+			continue
+		}
+		t.ts.wg.Add(1)
+		go func() {
+			defer t.ts.wg.Done()
+			t.start(conn)
+		}()
+	}
+
+	if !t.ts.wait(shutdownTimeout) {
+		Warn.Println("Timed out waiting for telnet sessions to end")
 	}
+	Info.Println("Telnet server stopped")
 }
 
 // telnetConn is a Conn consisting of a TCPConn and a ReaderWriter.
 //
 // The ReaderWriter is a telnet ReadWriter which dispatches to the TCPConn.
 // Depending on the terminal type it may also be wrapped with a character
-// transformer.
+// transformer.  It also holds the session's unit system and the templates
+// for showing values in it.  Writes are serialized since the server writes
+// a goodbye message when it shuts down.
 type telnetConn struct {
 	io.Reader
 	io.Writer
 	net.Conn
+	units unitSystem
+	tmpl  *template.Template // Templates for the unit system, nil for imperial
+	mu    sync.Mutex
 }
 
-func (c telnetConn) Read(b []byte) (n int, err error) { return c.Reader.Read(b) }
-func (c telnetConn) Write(b []byte) (int, error)      { return c.Writer.Write(b) }
+func (c *telnetConn) Read(b []byte) (n int, err error) { return c.Reader.Read(b) }
+func (c *telnetConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.Writer.Write(b)
+}
+
+// setUnits changes the session's unit system.  The templates are cloned
+// with the unit functions once here rather than on every render.
+func (c *telnetConn) setUnits(u unitSystem, t *template.Template) {
+	var tmpl *template.Template
+	if u != imperial {
+		tmpl = template.Must(t.Clone()).Funcs(unitFuncs(u))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.units, c.tmpl = u, tmpl
+}
+
+// templates returns the session's templates, or t if the session uses
+// imperial units.
+func (c *telnetConn) templates(t *template.Template) *template.Template {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tmpl == nil {
+		return t
+	}
+
+	return c.tmpl
+}
 
 // start sets up a new telnet session and a character transformer, if
 // necessary.  It then passes control to the prompt for the duration of
@@ -142,7 +307,15 @@ func (t telnetCtx) start(conn net.Conn) {
 		r, w = tn, tn
 	}
 
-	t.prompt(telnetConn{Reader: r, Writer: w, Conn: conn})
+	// The server may have started shutting down during negotiation.
+	tc := &telnetConn{Reader: r, Writer: w, Conn: conn, units: imperial}
+	if !t.ts.add(tc) {
+		t.template(tc, "shutdown", nil)
+		return
+	}
+	defer t.ts.remove(tc)
+
+	t.prompt(tc)
 }
 
 // prompt is the shell or "main menu" prompt for the telnet Conn.
@@ -258,13 +431,32 @@ func (t *telnetCtx) parseTemplates(p string) (err error) {
 		"longTime": func(t time.Time) string {
 			return t.Format("Monday, January 2 2006 at 15:04:05")
 		},
-		"metar": metar,
+		"metar": t.report,
 		"noColor": func() string {
 			return t.ansiEsc("0")
 		},
+		"summaryTime": func(p archive.Period, t time.Time) string {
+			switch p {
+			case archive.Year:
+				return t.Format("2006")
+			case archive.Month:
+				return t.Format("Jan 2006")
+			default:
+				return t.Format("Mon 01/02")
+			}
+		},
 		"sunTime": func(t time.Time) string {
 			return t.Format("15:04")
 		},
+		"topics": func(topics []string) string {
+			if len(topics) < 1 {
+				return "*"
+			}
+			return strings.Join(topics, ",")
+		},
+	}
+	for name, f := range unitFuncs(imperial) {
+		fmap[name] = f
 	}
 	t.t, err = template.New("").Funcs(fmap).ParseGlob(p)
 
@@ -319,14 +511,58 @@ func (telnetCtx) readLine(rw io.ReadWriter) (s string, err error) {
 	}
 }
 
+// unitFuncs returns the template functions for showing values in a unit
+// system.
+func unitFuncs(u unitSystem) template.FuncMap {
+	return template.FuncMap{
+		"convert": func(qty string, i interface{}) float64 {
+			switch i := i.(type) {
+			case int:
+				return u.convert(qty, float64(i))
+			case float64:
+				return u.convert(qty, i)
+			default:
+				return 0
+			}
+		},
+		"digits": u.digits,
+		"stuckValue": func(s stuckSensor) string {
+			qty := fieldQuantity(s.Field)
+			if qty == "" {
+				return strconv.FormatFloat(s.Value, 'f', -1, 64)
+			}
+			p := math.Pow10(u.digits(qty))
+			v := math.Round(u.convert(qty, s.Value)*p) / p
+			return strconv.FormatFloat(v, 'f', -1, 64) + u.label(qty)
+		},
+		"unit":  u.label,
+		"units": func() unitSystem { return u },
+	}
+}
+
+// connTemplates returns the templates of the telnet session the writer
+// belongs to.
+func (t telnetCtx) connTemplates(w io.Writer) *template.Template {
+	if e, ok := w.(textcmd.Env); ok {
+		w = e.Conn
+	}
+	if tc, ok := w.(*telnetConn); ok {
+		return tc.templates(t.t)
+	}
+
+	return t.t
+}
+
 // template executes the named template with the specified data
-// and sends the output to the Conn.
+// and sends the output to the Conn in a single write so it's not
+// interleaved with other output.  Values are shown in the session's
+// unit system.
 func (t telnetCtx) template(w io.Writer, name string, data interface{}) {
-	bw := bufio.NewWriter(w)
-	err := t.t.ExecuteTemplate(bw, name, data)
+	var b bytes.Buffer
+	err := t.connTemplates(w).ExecuteTemplate(&b, name, data)
 	if err != nil {
 		Error.Printf("Template %s error: %s", name, err.Error())
-		fmt.Fprintf(bw, "Content not available.\r\n")
+		fmt.Fprintf(&b, "Content not available.\r\n")
 	}
-	bw.Flush()
+	w.Write(b.Bytes())
 }
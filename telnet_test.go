@@ -0,0 +1,107 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTelnetSessionsClose(t *testing.T) {
+	a := assert.New(t)
+
+	// Pipes are unbuffered so a client that never reads stalls writes.
+	ts := newTelnetSessions()
+	stalled, _ := net.Pipe()
+	server, client := net.Pipe()
+	ts.add(stalled)
+	ts.add(server)
+	a.Equal(2, ts.count())
+
+	goodbye := make(chan string)
+	go func() {
+		b := make([]byte, 64)
+		n, _ := client.Read(b)
+		goodbye <- string(b[:n])
+	}()
+
+	begin := time.Now()
+	ts.close(func(conn net.Conn) {
+		conn.Write([]byte("goodbye\r\n"))
+	})
+	a.Less(time.Since(begin), 2*telnetGoodbyeWait, "Stalled client held up shutdown")
+	a.Equal("goodbye\r\n", <-goodbye)
+
+	_, err := server.Write([]byte{0})
+	a.ErrorIs(err, io.ErrClosedPipe)
+
+	// Sessions end as usual once they've been closed.
+	ts.remove(stalled)
+	ts.remove(server)
+	a.Zero(ts.count())
+
+	// Sessions that finish negotiating after the close aren't added.
+	late, _ := net.Pipe()
+	a.False(ts.add(late))
+	a.Zero(ts.count())
+}
+
+func TestTelnetSessionsWait(t *testing.T) {
+	a := assert.New(t)
+
+	ts := newTelnetSessions()
+	a.True(ts.wait(time.Millisecond), "No sessions")
+
+	ts.wg.Add(1)
+	a.False(ts.wait(10*time.Millisecond), "Session never ended")
+
+	ts.wg.Done()
+	a.True(ts.wait(time.Second), "Session ended")
+}
+
+func TestTelnetUnits(t *testing.T) {
+	a := assert.New(t)
+
+	ar, err := archive.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+
+	tc := telnetCtx{serverCtx: serverCtx{ar: &ar, lb: &loopBuffer{}}}
+	err = tc.parseTemplates("tmpl/telnet/*.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	conn := &telnetConn{Writer: &b, units: imperial}
+	a.Equal(tc.t, conn.templates(tc.t), "Imperial sessions use the default templates")
+
+	// Templates are cloned once when the units change.
+	conn.setUnits(unitSystems["metric"], tc.t)
+	tmpl := conn.templates(tc.t)
+	a.NotEqual(tc.t, tmpl)
+	a.Same(tmpl, conn.templates(tc.t))
+
+	l := loop{}
+	l.ET.Today = 0.1
+	tc.template(conn, "loop", l)
+	a.Contains(b.String(), "ET Today: 2.5 mm")
+	a.Contains(b.String(), "mm\r\n", "Lines end with CRLF")
+
+	b.Reset()
+	conn.setUnits(imperial, tc.t)
+	a.Equal(tc.t, conn.templates(tc.t))
+	tc.template(conn, "loop", l)
+	a.Contains(b.String(), "ET Today: 0.10in")
+}
@@ -5,12 +5,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ebarkie/davis-station/internal/archive"
 	"github.com/ebarkie/textcmd"
 	"github.com/ebarkie/weatherlink"
 	"github.com/ebarkie/weatherlink/data"
@@ -26,8 +29,13 @@ func (t telnetCtx) archive(e textcmd.Env) (err error) {
 		}
 	}
 
+	// The template stops ranging over the records if it fails so the
+	// iteration is cancelled when it's done.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	d := time.Duration(h) * time.Hour
-	ac := t.ar.NewGet(time.Now().Add(-d), time.Now())
+	ac := t.ar.Iter(ctx, archive.Query{Begin: time.Now().Add(-d), End: time.Now()})
 	t.template(e, "archive", ac)
 
 	return
@@ -36,10 +44,22 @@ func (t telnetCtx) archive(e textcmd.Env) (err error) {
 func (t telnetCtx) health(e textcmd.Env) error {
 	_, lastLoop := t.lb.last()
 
+	type qcRow struct {
+		Name string
+		qcCounts
+	}
+	qs := t.qs.report(time.Now())
+
 	t.template(e, "health",
 		struct {
-			Bat data.LoopBat
-		}{lastLoop.Bat},
+			Bat   data.LoopBat
+			Stuck []stuckSensor
+			QC    []qcRow
+		}{lastLoop.Bat, t.hl.get(), []qcRow{
+			{"Last hour", qs.LastHour},
+			{"Last 24 hours", qs.Last24Hours},
+			{qs.Since.Format("Since Jan 02"), qs.Total},
+		}},
 	)
 
 	return nil
@@ -107,14 +127,23 @@ func (t telnetCtx) loop(e textcmd.Env) error {
 	printLoop(lastLoop)
 
 	if watch {
-		events := t.eb.Subscribe(e.RemoteAddr().String())
-		defer t.eb.Unsubscribe(events)
+		ec := t.eb.Subscribe(e.RemoteAddr().String(), "loop")
+		defer t.eb.Unsubscribe(ec)
 		go func() {
-			for ev := range events {
+			for ev := range ec {
 				if lastLoop, ok := ev.Data.(loop); ok {
 					printLoop(lastLoop)
 				}
 			}
+
+			// The channel is closed if the broker evicted us for falling
+			// too far behind or the server is shutting down, in which case
+			// the session is closed for us.
+			select {
+			case <-t.eb.Done():
+			default:
+				fmt.Fprintf(e, "\r\nFell too far behind, stopped watching.  Press any key to end.")
+			}
 		}()
 
 		t.readOne(e)
@@ -130,6 +159,103 @@ func (t telnetCtx) quit(e textcmd.Env) error {
 	return textcmd.ErrCmdQuit
 }
 
+func (t telnetCtx) qc(e textcmd.Env) (err error) {
+	// Default quarantine period is 24 hours
+	h := 24
+	if a := e.Arg(1); a != "" {
+		h, err = strconv.Atoi(a)
+		if err != nil {
+			return
+		}
+	}
+
+	d := time.Duration(h) * time.Hour
+	t.template(e, "qc", t.ar.Rejects(time.Now().Add(-d), time.Now()))
+
+	return
+}
+
+func (t telnetCtx) setUnits(e textcmd.Env) error {
+	tc, ok := e.Conn.(*telnetConn)
+	if !ok {
+		return errors.New("units can't be changed for this session")
+	}
+
+	// A unit system or a quantity and its units
+	switch {
+	case e.Arg(2) != "":
+		u := tc.units
+		if err := u.set(e.Arg(1), e.Arg(2)); err != nil {
+			return err
+		}
+		tc.setUnits(u, t.t)
+	case e.Arg(1) != "":
+		u, err := parseUnitSystem(e.Arg(1))
+		if err != nil {
+			return err
+		}
+		tc.setUnits(u, t.t)
+	}
+	t.template(e, "units", tc.units)
+
+	return nil
+}
+
+func (t telnetCtx) subscribers(e textcmd.Env) error {
+	t.template(e, "subscribers", t.eb.Subscribers())
+
+	return nil
+}
+
+func (t telnetCtx) summary(e textcmd.Env) (err error) {
+	// Default summary period is daily for the last 7 days
+	p := archive.Day
+	if a := e.Arg(1); a != "" {
+		p = archive.Period(a)
+	}
+
+	n := 7
+	if a := e.Arg(2); a != "" {
+		n, err = strconv.Atoi(a)
+		if err != nil {
+			return
+		}
+	}
+
+	var begin time.Time
+	switch p {
+	case archive.Year:
+		begin = time.Now().AddDate(-n+1, 0, 0)
+	case archive.Month:
+		begin = time.Now().AddDate(0, -n+1, 0)
+	default:
+		begin = time.Now().AddDate(0, 0, -n+1)
+	}
+
+	summaries, err := t.ar.Summaries(p, begin, time.Now())
+	if err != nil {
+		return
+	}
+	t.template(e, "summary",
+		struct {
+			Period    archive.Period
+			Summaries []archive.Summary
+		}{p, summaries},
+	)
+
+	return
+}
+
+func (t telnetCtx) synop(e textcmd.Env) error {
+	numLoops, lastLoop := t.lb.last()
+	if numLoops < loopsMin {
+		return errLoopsMin
+	}
+	t.template(e, "synop", t.synopReport(lastLoop))
+
+	return nil
+}
+
 func (t telnetCtx) time(e textcmd.Env) error {
 	t.template(e, "time",
 		struct {
@@ -145,7 +271,8 @@ func (t telnetCtx) uname(e textcmd.Env) error {
 		struct {
 			Banner    string
 			LocalAddr net.Addr
-		}{banner, e.LocalAddr()},
+			Station   stationInfo
+		}{banner, e.LocalAddr(), t.stn},
 	)
 
 	return nil
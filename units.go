@@ -0,0 +1,355 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// Unit systems for reporting values in something other than the console's
+// imperial units.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/ebarkie/weatherlink/units"
+)
+
+// Quantities that can be reported in different units.
+const (
+	qtyTemperature = "temperature"
+	qtyPressure    = "pressure"
+	qtySpeed       = "speed"
+	qtyRain        = "rain"
+)
+
+// unitSystem is the units each quantity is reported in.
+type unitSystem struct {
+	Temperature string `json:"temperature"` // "F", "C", or "K"
+	Pressure    string `json:"pressure"`    // "inHg", "hPa", "kPa", or "mmHg"
+	Speed       string `json:"speed"`       // "mph", "kph", "mps", or "knots"
+	Rain        string `json:"rain"`        // "in", "mm", or "cm"
+}
+
+// Unit systems.  SI uses meters per second for speed but otherwise the
+// more familiar metric units.
+var unitSystems = map[string]unitSystem{
+	"imperial": {Temperature: "F", Pressure: "inHg", Speed: "mph", Rain: "in"},
+	"metric":   {Temperature: "C", Pressure: "hPa", Speed: "kph", Rain: "mm"},
+	"si":       {Temperature: "C", Pressure: "hPa", Speed: "mps", Rain: "mm"},
+}
+
+// imperial is the console's native unit system.
+var imperial = unitSystems["imperial"]
+
+// unitNames are the valid units for each quantity keyed by their lower case
+// name.
+var unitNames = map[string]map[string]string{
+	qtyTemperature: {"f": "F", "c": "C", "k": "K"},
+	qtyPressure:    {"inhg": "inHg", "hpa": "hPa", "kpa": "kPa", "mmhg": "mmHg"},
+	qtySpeed:       {"mph": "mph", "kph": "kph", "mps": "mps", "knots": "knots"},
+	qtyRain:        {"in": "in", "mm": "mm", "cm": "cm"},
+}
+
+// set sets the units for a quantity.  The quantity and units are case
+// insensitive.
+func (u *unitSystem) set(qty, name string) error {
+	names, ok := unitNames[strings.ToLower(qty)]
+	if !ok {
+		return fmt.Errorf("unknown quantity %q", qty)
+	}
+	n, ok := names[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown %s units %q", qty, name)
+	}
+
+	switch strings.ToLower(qty) {
+	case qtyTemperature:
+		u.Temperature = n
+	case qtyPressure:
+		u.Pressure = n
+	case qtySpeed:
+		u.Speed = n
+	case qtyRain:
+		u.Rain = n
+	}
+
+	return nil
+}
+
+// parseUnitSystem returns the named unit system.  An empty name is
+// imperial.
+func parseUnitSystem(name string) (unitSystem, error) {
+	if name == "" {
+		return imperial, nil
+	}
+	u, ok := unitSystems[strings.ToLower(name)]
+	if !ok {
+		return u, fmt.Errorf("unknown unit system %q", name)
+	}
+
+	return u, nil
+}
+
+// unitsQuery parses the units query parameter and any per-quantity
+// overrides, e.g. "?units=metric&speed=knots".
+func unitsQuery(q url.Values) (u unitSystem, err error) {
+	u, err = parseUnitSystem(q.Get("units"))
+	if err != nil {
+		return
+	}
+
+	for _, qty := range []string{qtyTemperature, qtyPressure, qtySpeed, qtyRain} {
+		if name := q.Get(qty); name != "" {
+			if err = u.set(qty, name); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// temp converts a temperature from Fahrenheit.
+func (u unitSystem) temp(f float64) float64 {
+	switch u.Temperature {
+	case "C":
+		return units.Fahrenheit(f).Celsius()
+	case "K":
+		return units.Fahrenheit(f).Celsius() + 273.15
+	default:
+		return f
+	}
+}
+
+// pressure converts a pressure from inches of mercury.
+func (u unitSystem) pressure(in float64) float64 {
+	mb := units.Pressure(in * units.Inches).Millibars()
+	switch u.Pressure {
+	case "hPa":
+		return mb
+	case "kPa":
+		return mb / 10
+	case "mmHg":
+		return in * 25.4
+	default:
+		return in
+	}
+}
+
+// speed converts a speed from miles per hour.
+func (u unitSystem) speed(mph float64) float64 {
+	kn := units.Speed(mph * units.MPH).Knots()
+	switch u.Speed {
+	case "kph":
+		return kn * 1.852
+	case "mps":
+		return kn * 1852 / 3600
+	case "knots":
+		return kn
+	default:
+		return mph
+	}
+}
+
+// rain converts a precipitation or evapotranspiration amount from inches.
+func (u unitSystem) rain(in float64) float64 {
+	switch u.Rain {
+	case "mm":
+		return in * 25.4
+	case "cm":
+		return in * 2.54
+	default:
+		return in
+	}
+}
+
+// convert converts a value of a quantity from imperial units.
+func (u unitSystem) convert(qty string, v float64) float64 {
+	switch qty {
+	case qtyTemperature:
+		return u.temp(v)
+	case qtyPressure:
+		return u.pressure(v)
+	case qtySpeed:
+		return u.speed(v)
+	case qtyRain:
+		return u.rain(v)
+	default:
+		return v
+	}
+}
+
+// label returns the units label for a quantity.
+func (u unitSystem) label(qty string) string {
+	switch qty {
+	case qtyTemperature:
+		if u.Temperature == "K" {
+			return "K"
+		}
+		return "°" + u.Temperature
+	case qtyPressure:
+		if u.Pressure == "inHg" {
+			return "in"
+		}
+		return u.Pressure
+	case qtySpeed:
+		return map[string]string{"mph": "mph", "kph": "km/h", "mps": "m/s", "knots": "kn"}[u.Speed]
+	case qtyRain:
+		return u.Rain
+	default:
+		return ""
+	}
+}
+
+// digits returns a sensible number of decimal places for a quantity.
+func (u unitSystem) digits(qty string) int {
+	switch qty {
+	case qtyTemperature:
+		return 2
+	case qtyPressure:
+		return map[string]int{"inHg": 3, "hPa": 1, "kPa": 2, "mmHg": 1}[u.Pressure]
+	case qtySpeed:
+		if u.Speed == "mps" {
+			return 1
+		}
+		return 0
+	case qtyRain:
+		if u.Rain == "mm" {
+			return 1
+		}
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Quantities of the loop and archive fields by their JSON path.  Arrays of
+// optional sensors are converted element by element.
+var (
+	loopQuantities = map[string]string{
+		"ET.lastMonth":                    qtyRain,
+		"ET.lastYear":                     qtyRain,
+		"ET.today":                        qtyRain,
+		"THSWIndex":                       qtyTemperature,
+		"barometer.altimeter":             qtyPressure,
+		"barometer.seaLevel":              qtyPressure,
+		"barometer.station":               qtyPressure,
+		"dewPoint":                        qtyTemperature,
+		"extraTemperature":                qtyTemperature,
+		"heatIndex":                       qtyTemperature,
+		"insideTemperature":               qtyTemperature,
+		"leafTemperature":                 qtyTemperature,
+		"outsideTemperature":              qtyTemperature,
+		"rain.accumulation.last15Minutes": qtyRain,
+		"rain.accumulation.last24Hours":   qtyRain,
+		"rain.accumulation.lastHour":      qtyRain,
+		"rain.accumulation.lastMonth":     qtyRain,
+		"rain.accumulation.lastYear":      qtyRain,
+		"rain.accumulation.storm":         qtyRain,
+		"rain.accumulation.today":         qtyRain,
+		"rain.rate":                       qtyRain,
+		"soilTemperature":                 qtyTemperature,
+		"wind.average.last10MinutesSpeed": qtySpeed,
+		"wind.average.last2MinutesSpeed":  qtySpeed,
+		"wind.current.speed":              qtySpeed,
+		"wind.gust.last10MinutesSpeed":    qtySpeed,
+		"windChill":                       qtyTemperature,
+	}
+
+	archiveQuantities = map[string]string{
+		"ET":                     qtyRain,
+		"barometer":              qtyPressure,
+		"extraTemperature":       qtyTemperature,
+		"insideTemperature":      qtyTemperature,
+		"leafTemperature":        qtyTemperature,
+		"outsideTemperature":     qtyTemperature,
+		"outsideTemperatureHigh": qtyTemperature,
+		"outsideTemperatureLow":  qtyTemperature,
+		"rainAccumulation":       qtyRain,
+		"rainRateHigh":           qtyRain,
+		"soilTemperature":        qtyTemperature,
+		"windSpeedAverage":       qtySpeed,
+		"windSpeedHigh":          qtySpeed,
+	}
+)
+
+// fieldQuantity returns the quantity of a loop or archive field, like
+// "soilTemperature[0]", or an empty string if it doesn't have units.
+func fieldQuantity(field string) string {
+	field, _, _ = strings.Cut(field, "[")
+	if qty, ok := loopQuantities[field]; ok {
+		return qty
+	}
+
+	return archiveQuantities[field]
+}
+
+// convertJSON converts the numbers at a JSON path, or in the array at the
+// path, of a generic JSON value.
+func (u unitSystem) convertJSON(v interface{}, path []string, qty string) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(path) < 1 {
+		return
+	}
+
+	if len(path) > 1 {
+		u.convertJSON(m[path[0]], path[1:], qty)
+		return
+	}
+
+	conv := func(f float64) float64 {
+		// Converted values are rounded to avoid meaningless precision.
+		return math.Round(u.convert(qty, f)*1000) / 1000
+	}
+	switch x := m[path[0]].(type) {
+	case float64:
+		m[path[0]] = conv(x)
+	case []interface{}:
+		for i := range x {
+			if f, ok := x[i].(float64); ok {
+				x[i] = conv(f)
+			}
+		}
+	}
+}
+
+// marshal returns loops and archive records, or slices of them, as JSON in
+// the unit system.  Anything else is unchanged.
+func (u unitSystem) marshal(v interface{}) ([]byte, error) {
+	var qs map[string]string
+	switch v.(type) {
+	case loop, []loop:
+		qs = loopQuantities
+	case archive.Record, []archive.Record:
+		qs = archiveQuantities
+	}
+	if u == imperial || qs == nil {
+		return json.Marshal(v)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var g interface{}
+	err = json.Unmarshal(b, &g)
+	if err != nil {
+		return nil, err
+	}
+
+	objs, ok := g.([]interface{})
+	if !ok {
+		objs = []interface{}{g}
+	}
+	for _, obj := range objs {
+		for p, qty := range qs {
+			u.convertJSON(obj, strings.Split(p, "."), qty)
+		}
+	}
+
+	return json.Marshal(g)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitsQuery(t *testing.T) {
+	a := assert.New(t)
+
+	u, err := unitsQuery(url.Values{})
+	a.Nil(err)
+	a.Equal(imperial, u)
+
+	u, err = unitsQuery(url.Values{"units": {"Metric"}, "speed": {"KNOTS"}})
+	a.Nil(err)
+	a.Equal(unitSystem{Temperature: "C", Pressure: "hPa", Speed: "knots", Rain: "mm"}, u)
+
+	u, err = unitsQuery(url.Values{"temperature": {"k"}, "pressure": {"inhg"}})
+	a.Nil(err)
+	a.Equal(unitSystem{Temperature: "K", Pressure: "inHg", Speed: "mph", Rain: "in"}, u)
+
+	_, err = unitsQuery(url.Values{"units": {"furlongs"}})
+	a.NotNil(err)
+	_, err = unitsQuery(url.Values{"rain": {"ft"}})
+	a.NotNil(err)
+}
+
+func TestUnitsConvert(t *testing.T) {
+	a := assert.New(t)
+
+	si := unitSystems["si"]
+	a.InDelta(0.0, si.temp(32.0), 0.001)
+	a.InDelta(373.15, unitSystem{Temperature: "K"}.temp(212.0), 0.001)
+	a.InDelta(1013.21, si.pressure(29.92), 0.01)
+	a.InDelta(101.321, unitSystem{Pressure: "kPa"}.pressure(29.92), 0.001)
+	a.InDelta(759.968, unitSystem{Pressure: "mmHg"}.pressure(29.92), 0.001)
+	a.InDelta(4.470, si.speed(10.0), 0.001)
+	a.InDelta(16.093, unitSystems["metric"].speed(10.0), 0.001)
+	a.InDelta(8.690, unitSystem{Speed: "knots"}.speed(10.0), 0.001)
+	a.InDelta(25.4, si.rain(1.0), 0.001)
+	a.InDelta(2.54, unitSystem{Rain: "cm"}.rain(1.0), 0.001)
+
+	a.Equal(70.5, imperial.convert(qtyTemperature, 70.5))
+	a.Equal(qtyTemperature, fieldQuantity("soilTemperature[1]"))
+	a.Equal(qtySpeed, fieldQuantity("windSpeedHigh"))
+	a.Equal("", fieldQuantity("outsideHumidity"))
+}
+
+func TestUnitsMarshal(t *testing.T) {
+	a := assert.New(t)
+
+	l := loop{}
+	l.OutTemp = 212.0
+	l.OutHumidity = 50
+	l.Bar.SeaLevel = 29.92
+	l.Rain.Accum.Today = 1.0
+	l.Wind.Cur.Speed = 10
+	soil := 32
+	l.SoilTemp[0] = &soil
+
+	b, err := unitSystems["metric"].marshal(l)
+	a.Nil(err)
+	var m map[string]interface{}
+	a.Nil(json.Unmarshal(b, &m))
+	a.Equal(100.0, m["outsideTemperature"])
+	a.Equal(50.0, m["outsideHumidity"], "Quantities without units are unchanged")
+	a.InDelta(1013.21, m["barometer"].(map[string]interface{})["seaLevel"], 0.01)
+	a.Equal(25.4, m["rain"].(map[string]interface{})["accumulation"].(map[string]interface{})["today"])
+	a.Equal(16.093, m["wind"].(map[string]interface{})["current"].(map[string]interface{})["speed"])
+	a.Equal(0.0, m["soilTemperature"].([]interface{})[0])
+
+	rec := archive.Record{}
+	rec.WindSpeedHi = 10
+	b, err = unitSystems["si"].marshal([]archive.Record{rec})
+	a.Nil(err)
+	var rs []map[string]interface{}
+	a.Nil(json.Unmarshal(b, &rs))
+	a.Equal(4.47, rs[0]["windSpeedHigh"])
+
+	b, err = imperial.marshal(l)
+	a.Nil(err)
+	imp, _ := json.Marshal(l)
+	a.Equal(imp, b)
+}
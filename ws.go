@@ -0,0 +1,229 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+// WebSocket events streaming with client control messages.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/events"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second    // Time allowed to write a message
+	wsPongWait   = 60 * time.Second    // Time allowed to read the next pong
+	wsPingPeriod = wsPongWait * 9 / 10 // Send pings at this period
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// Embedded displays and browser extensions connect from other
+	// origins and the streams are read-only, just like /events.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsMessage is a message sent to WebSocket clients.  Events use the same
+// names, ids, and JSON payloads as Server-sent events.  Problems with
+// client requests are sent as "error" events.
+type wsMessage struct {
+	Event string      `json:"event"`
+	ID    string      `json:"id,omitempty"`
+	Data  interface{} `json:"data"`
+}
+
+// wsRequest is a control message received from WebSocket clients.
+type wsRequest struct {
+	Action string `json:"action"`           // "subscribe", "replay", or "loop"
+	Events string `json:"events,omitempty"` // Subscribe to event names, e.g. "loop,archive"
+	ID     string `json:"id,omitempty"`     // Replay events after this loop sequence or archive timestamp
+}
+
+// wsSession is the state of a WebSocket client.
+type wsSession struct {
+	c      httpCtx
+	conn   *websocket.Conn
+	name   string
+	topics []string
+	ec     chan events.Event
+	cur    eventCursor
+}
+
+// write sends a message to the client.
+func (s *wsSession) write(m wsMessage) error {
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return s.conn.WriteJSON(m)
+}
+
+// send sends an event to the client and advances the cursor.
+func (s *wsSession) send(e events.Event) error {
+	s.cur.advance(e)
+	b, err := s.cur.units.marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	return s.write(wsMessage{Event: e.Name, ID: eventID(e), Data: json.RawMessage(b)})
+}
+
+// close sends a close message to the client.
+func (s *wsSession) close(code int, text string) {
+	s.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text), time.Now().Add(wsWriteWait))
+}
+
+// subscribe replaces the session's events subscription.
+func (s *wsSession) subscribe(topics []string) {
+	if s.ec != nil {
+		s.c.eb.Unsubscribe(s.ec)
+	}
+	s.topics = topics
+	s.ec = s.c.eb.Subscribe(s.name, topics...)
+}
+
+// handle processes a control message from the client.
+func (s *wsSession) handle(req wsRequest) error {
+	switch req.Action {
+	case "subscribe":
+		topics, err := events.Topics(req.Events)
+		if err != nil {
+			return s.write(wsMessage{Event: "error", Data: "bad events: " + err.Error()})
+		}
+		s.subscribe(topics)
+	case "replay":
+		// Live events are held while the replay is written so they're
+		// not dropped.
+		var live []events.Event
+		for _, e := range serverCtx(s.c).replay(req.ID, s.topics) {
+			if err := s.send(e); err != nil {
+				return err
+			}
+			live = hold(s.ec, live)
+		}
+		for _, e := range live {
+			if s.cur.sent(e) {
+				continue
+			}
+			if err := s.send(e); err != nil {
+				return err
+			}
+		}
+	case "loop":
+		numLoops, lastLoop := s.c.lb.last()
+		if numLoops < loopsMin {
+			return s.write(wsMessage{Event: "error", Data: errLoopsMin.Error()})
+		}
+		return s.send(events.Event{Name: "loop", Data: lastLoop})
+	default:
+		return s.write(wsMessage{Event: "error", Data: fmt.Sprintf("invalid action %q", req.Action)})
+	}
+
+	return nil
+}
+
+// ws is the endpoint for streaming events over a WebSocket.
+// GET /ws[?events=loop,archive][&units=imperial|metric|si]
+func (c httpCtx) ws(w http.ResponseWriter, r *http.Request) {
+	// Optional comma separated list of event names to receive, with
+	// wildcard support.  The default is all events.
+	topics, err := events.Topics(r.URL.Query().Get("events"))
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u, err := unitsQuery(r.URL.Query())
+	if err != nil {
+		w.Header().Set("Warning", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already sent an error response
+		Debug.Printf("WebSocket upgrade error: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	s := &wsSession{c: c, conn: conn, name: r.RemoteAddr, cur: newEventCursor(u)}
+	s.subscribe(topics)
+	defer func() { c.eb.Unsubscribe(s.ec) }()
+
+	// Read control messages until the client goes away.  Only this
+	// goroutine writes to the connection so requests are passed back.
+	reqs := make(chan wsRequest)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		defer close(done)
+
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			return nil
+		})
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			// Malformed requests have no action
+			var req wsRequest
+			if json.Unmarshal(msg, &req) != nil {
+				req = wsRequest{}
+			}
+
+			select {
+			case reqs <- req:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-done:
+			// Client closed the connection
+			return
+		case req := <-reqs:
+			if s.handle(req) != nil {
+				return
+			}
+		case <-ping.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			if err != nil {
+				return
+			}
+		case e, ok := <-s.ec:
+			if !ok {
+				select {
+				case <-c.eb.Done():
+					s.close(websocket.CloseGoingAway, "server shutting down, goodbye")
+				default:
+					Warn.Printf("WebSocket subscriber %s fell too far behind", r.RemoteAddr)
+					s.close(websocket.CloseTryAgainLater, "fell too far behind")
+				}
+				return
+			}
+			if s.cur.sent(e) {
+				continue
+			}
+			if s.send(e) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2016 Eric Barkie. All rights reserved.
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ebarkie/davis-station/internal/archive"
+	"github.com/ebarkie/davis-station/internal/events"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// wsTestMessage is a message received by a WebSocket test client.
+type wsTestMessage struct {
+	Event string          `json:"event"`
+	ID    string          `json:"id"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// testWSServer creates a server context with an empty archive and loop
+// buffer and starts a test server for the WebSocket endpoint.
+func testWSServer(t *testing.T) (serverCtx, *httptest.Server) {
+	ar, err := archive.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ar.Close() })
+
+	sc := serverCtx{ar: &ar, lb: &loopBuffer{}, eb: events.New()}
+	t.Cleanup(sc.eb.Close)
+
+	srv := httptest.NewServer(http.HandlerFunc(httpCtx(sc).ws))
+	t.Cleanup(srv.Close)
+
+	return sc, srv
+}
+
+// testWSDial connects to the WebSocket test server and waits until the
+// session has subscribed to the topics.
+func testWSDial(t *testing.T, sc serverCtx, srv *httptest.Server, query string, topics ...string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	testWSSubscribed(t, sc, topics...)
+
+	return conn
+}
+
+// testWSSubscribed waits until there is a single subscriber to the topics.
+func testWSSubscribed(t *testing.T, sc serverCtx, topics ...string) {
+	for i := 0; i < 1000; i++ {
+		ss := sc.eb.Subscribers()
+		if len(ss) == 1 && reflect.DeepEqual(ss[0].Topics, topics) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Not subscribed to %v", topics)
+}
+
+// testWSRead reads the next message from the server.
+func testWSRead(t *testing.T, conn *websocket.Conn) (m wsTestMessage) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err := conn.ReadJSON(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+// testWSRequest sends a control message to the server.
+func testWSRequest(t *testing.T, conn *websocket.Conn, req string) {
+	err := conn.WriteMessage(websocket.TextMessage, []byte(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWSBadRequest(t *testing.T) {
+	a := assert.New(t)
+
+	for _, query := range []string{"?events=loop,[", "?units=furlongs"} {
+		w := httptest.NewRecorder()
+		httpCtx{}.ws(w, httptest.NewRequest("GET", "/ws"+query, nil))
+		a.Equal(http.StatusBadRequest, w.Code, query)
+		a.NotEmpty(w.Header().Get("Warning"), query)
+	}
+}
+
+func TestWSEvents(t *testing.T) {
+	a := assert.New(t)
+
+	sc, srv := testWSServer(t)
+	conn := testWSDial(t, sc, srv, "?events=loop", "loop")
+
+	// Only subscribed events are sent
+	sc.eb.Publish(events.Event{Name: "archive", Data: archive.Record{}})
+	sc.eb.Publish(events.Event{Name: "loop", Data: loop{Seq: 7}})
+	m := testWSRead(t, conn)
+	a.Equal("loop", m.Event)
+	a.Equal("7", m.ID)
+	var l loop
+	a.Nil(json.Unmarshal(m.Data, &l))
+	a.Equal(int64(7), l.Seq)
+
+	// Subscribing replaces the topics
+	testWSRequest(t, conn, `{"action":"subscribe","events":"stuck"}`)
+	testWSSubscribed(t, sc, "stuck")
+	sc.eb.Publish(events.Event{Name: "loop", Data: loop{Seq: 8}})
+	sc.eb.Publish(events.Event{Name: "stuck", Data: []stuckSensor{}})
+	m = testWSRead(t, conn)
+	a.Equal("stuck", m.Event)
+	a.Empty(m.ID)
+	a.Equal("[]", string(m.Data))
+}
+
+func TestWSErrors(t *testing.T) {
+	a := assert.New(t)
+
+	sc, srv := testWSServer(t)
+	conn := testWSDial(t, sc, srv, "")
+
+	for _, test := range []struct {
+		req string
+		exp string
+	}{
+		{`not json`, `"invalid action \"\""`},
+		{`{"action":"bogus"}`, `"invalid action \"bogus\""`},
+		{`{"action":"subscribe","events":"["}`, `"bad events: syntax error in pattern"`},
+		{`{"action":"loop"}`, `"` + errLoopsMin.Error() + `"`},
+	} {
+		testWSRequest(t, conn, test.req)
+		m := testWSRead(t, conn)
+		a.Equal("error", m.Event, test.req)
+		a.Equal(test.exp, string(m.Data), test.req)
+	}
+
+	// The session is still usable after errors
+	sc.eb.Publish(events.Event{Name: "loop", Data: loop{Seq: 1}})
+	a.Equal("loop", testWSRead(t, conn).Event)
+}
+
+func TestWSLoopAndReplay(t *testing.T) {
+	a := assert.New(t)
+
+	sc, srv := testWSServer(t)
+	ts := time.Now()
+	for i := int64(0); i < 5; i++ {
+		sc.lb.add(loop{Seq: i, Timestamp: ts.Add(time.Duration(i) * 2 * time.Second)})
+	}
+	conn := testWSDial(t, sc, srv, "?events=loop", "loop")
+
+	testWSRequest(t, conn, `{"action":"loop"}`)
+	m := testWSRead(t, conn)
+	a.Equal("loop", m.Event)
+	a.Equal("4", m.ID)
+
+	// Replays events after the id even if they were already sent
+	testWSRequest(t, conn, `{"action":"replay","id":"1"}`)
+	for _, id := range []string{"2", "3", "4"} {
+		m = testWSRead(t, conn)
+		a.Equal("loop", m.Event)
+		a.Equal(id, m.ID)
+	}
+
+	// Live events that were already replayed aren't sent twice
+	sc.eb.Publish(events.Event{Name: "loop", Data: loop{Seq: 4}})
+	sc.eb.Publish(events.Event{Name: "loop", Data: loop{Seq: 5}})
+	a.Equal("5", testWSRead(t, conn).ID)
+}
+
+func TestWSEviction(t *testing.T) {
+	a := assert.New(t)
+
+	sc, srv := testWSServer(t)
+	conn := testWSDial(t, sc, srv, "")
+
+	// Publish faster than the session can keep up until the subscriber
+	// falls too far behind.
+	big := strings.Repeat("x", 4096)
+	for i := 0; len(sc.eb.Subscribers()) > 0; i++ {
+		if i > 100000 {
+			t.Fatal("Subscriber was never evicted")
+		}
+		sc.eb.Publish(events.Event{Name: "loop", Data: big})
+	}
+
+	// The queued events are delivered and then the session is closed.
+	var err error
+	for err == nil {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = conn.ReadMessage()
+	}
+	a.True(websocket.IsCloseError(err, websocket.CloseTryAgainLater), err.Error())
+}
+
+func TestWSShutdown(t *testing.T) {
+	a := assert.New(t)
+
+	sc, srv := testWSServer(t)
+	conn := testWSDial(t, sc, srv, "")
+
+	sc.eb.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	a.True(websocket.IsCloseError(err, websocket.CloseGoingAway), err.Error())
+	a.Contains(err.Error(), "server shutting down")
+}